@@ -0,0 +1,328 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account is a registered user, we only keep the bcrypt hash
+// of the password (bcrypt salts it by itself). Role is "user",
+// "worker" or "admin" (see roles.go)
+type Account struct {
+	Username string    `json:"user"`
+	Hash     []byte    `json:"-"`
+	Role     string    `json:"role"`
+	Created  time.Time `json:"created_at"`
+	Limits   *Limits   `json:"limits,omitempty"` // nil uses the defaults
+}
+
+type AccountReq struct {
+	Username string `json:"user"`
+	Password string `json:"password"`
+}
+
+var Accounts []Account
+
+// where each account is in Accounts, authorize looks up the account
+// of every request
+var accountsIndex = make(map[string]int)
+var accountsLock sync.Mutex
+
+// used when the user doesnt exist, so the response takes
+// the same time and nobody can guess which users exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"),
+	bcrypt.DefaultCost)
+
+var minPasswordLen = 8
+
+// the controller sends this key in X-Cluster-Key to register
+// workers, set the same DPIP_CLUSTER_KEY in both of them
+var clusterKey string // see loadClusterKey
+
+// postUsers registers a new user, the body must be a json with
+// user and password. After this the user can POST /login
+func postUsers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: POST /users requested")
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var accountReq AccountReq
+	json.Unmarshal(body, &accountReq)
+
+	if accountReq.Username == "" || accountReq.Password == "" {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	if len(accountReq.Password) < minPasswordLen {
+		returnError(w, r, 400, fmt.Sprintf("the password must have at least "+
+			"%d characters", minPasswordLen))
+		return
+	}
+	if _, exists := searchAccount(accountReq.Username); exists {
+		returnError(w, r, 409, "the user "+accountReq.Username+" already exists")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(accountReq.Password),
+		bcrypt.DefaultCost)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt hash password")
+		return
+	}
+
+	var account Account
+	account.Username = accountReq.Username
+	account.Hash = hash
+	account.Role = roleUser
+	account.Created = time.Now().UTC()
+	if !addAccount(account) {
+		// somebody took it while we were hashing
+		returnError(w, r, 409, "the user "+accountReq.Username+" already exists")
+		return
+	}
+
+	w.WriteHeader(201)
+	returnMsg(w, "user "+account.Username+" has been registered, "+
+		"you can login now")
+}
+
+// getUsers lists the accounts of people (users and admins)
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /users requested")
+	json.NewEncoder(w).Encode(listAccounts(false))
+}
+
+// delUsers removes a user, its tokens stop working right away
+func delUsers(w http.ResponseWriter, r *http.Request) {
+	deleteAccount(w, r, false)
+}
+
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postUsers(w, r) // post
+	case http.MethodGet:
+		getUsers(w, r) // get
+	case http.MethodDelete:
+		delUsers(w, r) // delete
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+// postWorkers registers a worker account and returns its tokens,
+// only the controller can do it, it must send the cluster key.
+// Worker accounts dont have password, they use the refresh token,
+// and they can see the workloads of every user
+func postWorkers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: POST /workers requested")
+
+	if r.Header.Get("X-Cluster-Key") != clusterKey {
+		returnError(w, r, 403, "only the controller can register workers")
+		return
+	}
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var accountReq AccountReq
+	json.Unmarshal(body, &accountReq)
+	if accountReq.Username == "" {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	var account Account
+	account.Username = accountReq.Username
+	account.Role = roleWorker
+	account.Created = time.Now().UTC()
+	if !addAccount(account) {
+		returnError(w, r, 409, "the user "+accountReq.Username+" already exists")
+		return
+	}
+
+	login, err := newLogin(account.Username, account.Role)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create token")
+		return
+	}
+	login.Message = "worker " + account.Username + " has been registered"
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(login)
+}
+
+// getWorkers lists the worker accounts
+func getWorkers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /workers requested")
+	json.NewEncoder(w).Encode(listAccounts(true))
+}
+
+// delWorkers removes a worker, it wont be able to fetch or
+// upload images anymore
+func delWorkers(w http.ResponseWriter, r *http.Request) {
+	deleteAccount(w, r, true)
+}
+
+func handleWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postWorkers(w, r) // post
+	case http.MethodGet:
+		getWorkers(w, r) // get
+	case http.MethodDelete:
+		delWorkers(w, r) // delete
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// loadAdmin creates the admin account with DPIP_ADMIN_USER and
+// DPIP_ADMIN_PASSWORD, admins can't register through POST /users
+func loadAdmin() {
+	username := os.Getenv("DPIP_ADMIN_USER")
+	password := os.Getenv("DPIP_ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		fmt.Println("[WARN] DPIP_ADMIN_USER or DPIP_ADMIN_PASSWORD not " +
+			"set, there wont be an admin")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password),
+		bcrypt.DefaultCost)
+	if err != nil {
+		die("can't hash admin password: %s", err.Error())
+	}
+	var account Account
+	account.Username = username
+	account.Hash = hash
+	account.Role = roleAdmin
+	account.Created = time.Now().UTC()
+	addAccount(account)
+}
+
+func listAccounts(workers bool) []Account {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	accounts := []Account{}
+	for _, account := range Accounts {
+		if (account.Role == roleWorker) == workers {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+func deleteAccount(w http.ResponseWriter, r *http.Request, worker bool) {
+	username := mux.Vars(r)["user"]
+	fmt.Println("[INFO]: DELETE " + r.URL.Path + " requested")
+	if !removeAccount(username, worker) {
+		returnError(w, r, 404, "the account "+username+" doesnt exists")
+		return
+	}
+	removeKeys(username)
+	returnMsg(w, "the account "+username+" has been removed")
+}
+
+// loadClusterKey is called by Start, there's no default key,
+// without one anybody could register workers
+func loadClusterKey() string {
+	key := os.Getenv("DPIP_CLUSTER_KEY")
+	if key == "" {
+		die("DPIP_CLUSTER_KEY not set, the controller needs it to " +
+			"register workers")
+	}
+	return key
+}
+
+// Search account by username, returned account struct and boolean
+// that tells us if it was found.
+func searchAccount(username string) (Account, bool) {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	i, exists := accountsIndex[username]
+	if !exists {
+		var tmp Account
+		return tmp, false
+	}
+	return Accounts[i], true
+}
+
+// addAccount is false if the username is taken
+func addAccount(account Account) bool {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	if _, exists := accountsIndex[account.Username]; exists {
+		return false
+	}
+	accountsIndex[account.Username] = len(Accounts)
+	Accounts = append(Accounts, account)
+	return true
+}
+
+// setLimits is false if the account was removed meanwhile
+func setLimits(username string, limits Limits) bool {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	i, exists := accountsIndex[username]
+	if !exists {
+		return false
+	}
+	Accounts[i].Limits = &limits
+	return true
+}
+
+// removeAccount removes a worker account if worker is true, or
+// a user or admin if it's false
+func removeAccount(username string, worker bool) bool {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	i, exists := accountsIndex[username]
+	if !exists || (Accounts[i].Role == roleWorker) != worker {
+		return false
+	}
+	Accounts = append(Accounts[:i], Accounts[i+1:]...)
+	delete(accountsIndex, username)
+	for j := i; j < len(Accounts); j++ {
+		accountsIndex[Accounts[j].Username] = j
+	}
+	return true
+}
+
+// checkPassword returns the account if the password is right,
+// worker accounts dont have a password so they never match
+func checkPassword(username string, password string) (Account, bool) {
+	account, exists := searchAccount(username)
+	if !exists || account.Hash == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return account, false
+	}
+	err := bcrypt.CompareHashAndPassword(account.Hash, []byte(password))
+	return account, err == nil
+}
+
+// randomId returns 32 random bytes in hex
+func randomId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,289 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Animation keeps what we need to put an animated gif back
+// together once all of its frames have been filtered
+type Animation struct {
+	Id         uint64   `json:"animation_id"`
+	WorkloadId uint64   `json:"workload_id"`
+	Frames     []uint64 `json:"frames"`   // original image ids, in order
+	Delays     []int    `json:"delays"`   // 100ths of a second
+	Disposal   []int    `json:"disposal"` // gif.DisposalNone, ...
+	LoopCount  int      `json:"loop_count"`
+	Width      int      `json:"width"`
+	Height     int      `json:"height"`
+	Broken     bool     `json:"broken,omitempty"` // a frame was deleted
+}
+
+type AnimationMsg struct {
+	Message     string     `json:"message"`
+	WorkloadId  uint64     `json:"workload_id"`
+	AnimationId uint64     `json:"animation_id"`
+	Frames      []uint64   `json:"frames"`
+	Queue       *QueueInfo `json:"queue,omitempty"` // of the first frame
+}
+
+var Animations []Animation
+var animationsIds uint64
+
+// postAnimation is called by postImages when an animated gif is
+// uploaded. Every frame is rendered on top of the previous ones
+// (honoring the disposal method) so the workers receive exactly
+// what a viewer would see, then each frame is registered as an
+// original image and sent to the controller.
+func postAnimation(w http.ResponseWriter, r *http.Request,
+	workloadId uint64, anim *gif.GIF) {
+
+	frames, err := renderFrames(anim)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt render gif frames")
+		return
+	}
+
+	var size int64
+	for _, frame := range frames {
+		size += int64(len(frame))
+	}
+	if !checkQuota(w, r, len(frames), size) || !checkBacklog(w, r) {
+		return
+	}
+
+	var animation Animation
+	animation.WorkloadId = workloadId
+	animation.LoopCount = anim.LoopCount
+	animation.Width = anim.Config.Width
+	animation.Height = anim.Config.Height
+
+	// the animation and its frames are registered and pushed with
+	// the lock held, same as the archives
+	imagesLock.Lock()
+	animation.Id = animationsIds
+	animationsIds += 1
+	for i, frame := range frames {
+		var image Image
+		image.WorkloadId = workloadId
+		image.Id = imagesIds
+		imagesIds += 1
+		image.Type = "original"
+		image.Data = frame
+		image.Size = len(frame)
+		image.Owner = principal(r).Subject
+		image.CreatedAt = time.Now().UTC()
+
+		Images = append(Images, image)
+
+		animation.Frames = append(animation.Frames, image.Id)
+		animation.Delays = append(animation.Delays, anim.Delay[i])
+		var disposal int
+		if i < len(anim.Disposal) {
+			disposal = int(anim.Disposal[i])
+		}
+		animation.Disposal = append(animation.Disposal, disposal)
+	}
+	Animations = append(Animations, animation)
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		workload.Images = append(workload.Images, animation.Frames...)
+		workload.Animations = append(workload.Animations, animation.Id)
+	})
+
+	// all the frames go to the controller in one message
+	queue := queueInfo()
+	err = pushWorkload(workload, animation.Frames)
+	imagesLock.Unlock()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+
+	var msg AnimationMsg
+	msg = AnimationMsg{
+		Message: fmt.Sprintf("An animated gif has been successfully "+
+			"uploaded, %d frames will be filtered :)", len(frames)),
+		WorkloadId:  workloadId,
+		AnimationId: animation.Id,
+		Frames:      animation.Frames,
+		Queue:       queue,
+	}
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// getAnimations reassembles the filtered frames of an animation
+// into a gif, using the original delays, disposal and loop count.
+// If some frame hasn't been filtered yet it returns 409, if one was
+// deleted it returns 410, it wont ever be complete.
+func getAnimations(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /animations/ requested")
+	claims := principal(r) // see authorize
+
+	// read path params
+	vars := mux.Vars(r)
+	id := vars["animation_id"]
+	intId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	imagesLock.Lock()
+	var animation Animation
+	exists := intId < animationsIds
+	if exists {
+		animation = Animations[intId]
+	}
+	imagesLock.Unlock()
+	if !exists || !workloadExists(claims, animation.WorkloadId) {
+		returnError(w, r, 404, "the animation id doesnt exists")
+		return
+	}
+	if animation.Broken {
+		returnError(w, r, 410, "a frame of this animation was deleted, "+
+			"it cant be put back together")
+		return
+	}
+
+	var filtered []Image
+	for _, frameId := range animation.Frames {
+		image, exists := searchFiltered(frameId)
+		if !exists {
+			continue
+		}
+		filtered = append(filtered, image)
+	}
+	if len(filtered) < len(animation.Frames) {
+		returnError(w, r, 409, fmt.Sprintf("animation still being filtered, "+
+			"%d of %d frames are done", len(filtered),
+			len(animation.Frames)))
+		return
+	}
+
+	out, err := assembleAnimation(animation, filtered)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt assemble gif: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.WriteHeader(200)
+	gif.EncodeAll(w, out)
+}
+
+func handleAnimations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getAnimations(w, r) // get
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// renderFrames draws every frame of the gif over a canvas of the
+// size of the whole animation and returns each state as a png.
+// Disposal is applied after a frame is snapshotted, as the viewer
+// would do before drawing the next one.
+func renderFrames(anim *gif.GIF) ([][]byte, error) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	var frames [][]byte
+
+	for i, frame := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.Point{}, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min,
+			draw.Over)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, canvas); err != nil {
+			return nil, err
+		}
+		frames = append(frames, buf.Bytes())
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent,
+				image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, bounds, previous, image.Point{}, draw.Src)
+		}
+	}
+	return frames, nil
+}
+
+// assembleAnimation decodes the filtered frames and quantizes them
+// back to a palette so they can be encoded as a gif
+func assembleAnimation(animation Animation, filtered []Image) (*gif.GIF,
+	error) {
+	var out gif.GIF
+	out.LoopCount = animation.LoopCount
+	out.Config = image.Config{
+		ColorModel: color.Palette(palette.Plan9),
+		Width:      animation.Width,
+		Height:     animation.Height,
+	}
+
+	for i, frame := range filtered {
+		img, _, err := image.Decode(bytes.NewReader(frame.Data))
+		if err != nil {
+			return nil, err
+		}
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img,
+			img.Bounds().Min)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, animation.Delays[i])
+		out.Disposal = append(out.Disposal, byte(animation.Disposal[i]))
+	}
+	return &out, nil
+}
+
+// breakAnimations marks the animations the image is a frame of (or
+// a filtered version of a frame) as broken, see delImages. Needs
+// imagesLock
+func breakAnimations(image Image) {
+	frame := image.Id
+	if image.Type == "filtered" {
+		frame = image.SourceId
+	}
+	workload, _ := searchWorkload(image.WorkloadId)
+	for _, animId := range workload.Animations {
+		for _, id := range Animations[animId].Frames {
+			if id == frame {
+				Animations[animId].Broken = true
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var (
+	red         = color.RGBA{255, 0, 0, 255}
+	blue        = color.RGBA{0, 0, 255, 255}
+	transparent = color.RGBA{0, 0, 0, 0}
+)
+
+// testGif is 2x1, a red frame, then a blue pixel on the right, then
+// a transparent pixel on the left that shows whatever was left
+func testGif(disposal ...byte) *gif.GIF {
+	colors := color.Palette{transparent, red, blue}
+	frame := func(x, width int, index uint8) *image.Paletted {
+		img := image.NewPaletted(image.Rect(x, 0, x+width, 1), colors)
+		for i := range img.Pix {
+			img.Pix[i] = index
+		}
+		return img
+	}
+	return &gif.GIF{
+		Image: []*image.Paletted{frame(0, 2, 1), frame(1, 1, 2),
+			frame(0, 1, 0)},
+		Delay:     []int{10, 20, 30},
+		Disposal:  append(disposal, gif.DisposalNone),
+		LoopCount: 2,
+		Config:    image.Config{Width: 2, Height: 1},
+	}
+}
+
+func pixel(t *testing.T, frame []byte, x int) color.RGBA {
+	img, err := png.Decode(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return color.RGBAModel.Convert(img.At(x, 0)).(color.RGBA)
+}
+
+func TestRenderFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		disposal []byte
+		left     color.RGBA // of the second frame
+		right    color.RGBA // of the third frame
+	}{
+		{"none", []byte{gif.DisposalNone, gif.DisposalNone}, red, blue},
+		{"background after the first",
+			[]byte{gif.DisposalBackground, gif.DisposalNone}, transparent,
+			blue},
+		{"background after the second",
+			[]byte{gif.DisposalNone, gif.DisposalBackground}, red,
+			transparent},
+		{"previous after the second",
+			[]byte{gif.DisposalNone, gif.DisposalPrevious}, red, red},
+		{"no disposal sent", nil, red, blue},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			anim := testGif(test.disposal...)
+			if test.disposal == nil {
+				anim.Disposal = nil
+			}
+			frames, err := renderFrames(anim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 3 {
+				t.Fatalf("%d frames, want 3", len(frames))
+			}
+			if got := pixel(t, frames[0], 0); got != red {
+				t.Errorf("first frame %v, want red", got)
+			}
+			if got := pixel(t, frames[1], 0); got != test.left {
+				t.Errorf("left of the second frame %v, want %v", got,
+					test.left)
+			}
+			if got := pixel(t, frames[2], 1); got != test.right {
+				t.Errorf("right of the third frame %v, want %v", got,
+					test.right)
+			}
+		})
+	}
+}
+
+func TestAssembleAnimation(t *testing.T) {
+	anim := testGif(gif.DisposalBackground, gif.DisposalPrevious)
+	frames, err := renderFrames(anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	animation := Animation{Delays: anim.Delay, LoopCount: anim.LoopCount,
+		Disposal: []int{2, 3, 1}, Width: 2, Height: 1}
+	var filtered []Image
+	for _, frame := range frames {
+		filtered = append(filtered, Image{Data: frame})
+	}
+
+	out, err := assembleAnimation(animation, filtered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		t.Fatal(err)
+	}
+	back, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Image) != 3 || back.LoopCount != 2 {
+		t.Fatalf("%d frames and loop %d, want 3 and 2", len(back.Image),
+			back.LoopCount)
+	}
+	for i := range back.Image {
+		if back.Delay[i] != anim.Delay[i] ||
+			int(back.Disposal[i]) != animation.Disposal[i] {
+			t.Errorf("frame %d: delay %d disposal %d, want %d %d", i,
+				back.Delay[i], back.Disposal[i], anim.Delay[i],
+				animation.Disposal[i])
+		}
+	}
+
+	if _, err := assembleAnimation(animation,
+		[]Image{{Data: []byte("not a png")}}); err == nil {
+		t.Error("a frame that isnt an image was assembled")
+	}
+}
+
+func TestPostAnimation(t *testing.T) {
+	resetState(t)
+	controller := testController(t)
+	setAccounts(Account{Username: "ana", Role: roleUser})
+	Workloads = []Workload{{Id: 0, Filter: "blur", Owner: "ana",
+		Status: "scheduling"}}
+	workloadsIds = 1
+	var data bytes.Buffer
+	if err := gif.EncodeAll(&data, testGif(gif.DisposalNone,
+		gif.DisposalNone)); err != nil {
+		t.Fatal(err)
+	}
+
+	// gifs uploaded at the same time get their own ids and frames
+	uploads := 4
+	status := make(chan int)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			status <- upload(data.Bytes(), Claims{Subject: "ana",
+				Role: roleUser}, map[string]string{"workload_id": "0",
+				"type": "original"})
+		}()
+	}
+	for i := 0; i < uploads; i++ {
+		if got := <-status; got != 202 {
+			t.Fatalf("got %d, want 202", got)
+		}
+		if _, err := controller.Recv(); err != nil {
+			t.Fatalf("frames werent pushed: %v", err)
+		}
+	}
+
+	if len(Animations) != uploads || len(Images) != 3*uploads ||
+		len(Workloads[0].Animations) != uploads {
+		t.Fatalf("%d animations and %d images, want %d and %d",
+			len(Animations), len(Images), uploads, 3*uploads)
+	}
+	for i, animation := range Animations {
+		if animation.Id != uint64(i) ||
+			Workloads[0].Animations[i] != animation.Id {
+			t.Errorf("animation %d has id %d", i, animation.Id)
+		}
+		// the frames of one gif are one after the other
+		for j, frame := range animation.Frames {
+			if frame != animation.Frames[0]+uint64(j) {
+				t.Errorf("animation %d has frames %v", i, animation.Frames)
+				break
+			}
+		}
+	}
+}
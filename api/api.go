@@ -10,13 +10,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/gif"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -26,23 +29,24 @@ import (
 )
 
 type LoginResponse struct {
-	Message string `json:"message"`
-	Token   string `json:"token"`
+	Message      string `json:"message"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
 }
 
 type Image struct {
-	WorkloadId uint64 `json:"workload_id"`
-	Id         uint64 `json:"image_id"`
-	Type       string `json:"type"`
-	Data       []byte `json:"data"`
-	Size       int    `json:"size"`
-}
-
-type User struct {
-	Username string  `json:"user"`
-	Token    string  `json:"token"`
-	Images   []Image `json:"image"`
-	Time     string  `json:"time"`
+	WorkloadId uint64    `json:"workload_id"`
+	Id         uint64    `json:"image_id"`
+	Type       string    `json:"type"`
+	Data       []byte    `json:"data"`
+	Size       int       `json:"size"`
+	SourceId   uint64    `json:"source_id"` // original image, filtered only
+	Frame      int       `json:"frame"`     // position in sequence workloads
+	Owner      string    `json:"owner"`
+	CreatedAt  time.Time `json:"created_at"`
+	Filter     string    `json:"filter"`  // filtered only
+	Version    int       `json:"version"` // filtered only, see reprocess
 }
 
 type Status struct {
@@ -52,11 +56,12 @@ type Status struct {
 }
 
 type ImageMsg struct {
-	Message    string `json:"message"`
-	WorkloadId uint64 `json:"workload_id"`
-	ImageId    uint64 `json:"image_id"`
-	Type       string `json:"type"`
-	Size       int    `json:"size"`
+	Message    string     `json:"message"`
+	WorkloadId uint64     `json:"workload_id"`
+	ImageId    uint64     `json:"image_id"`
+	Type       string     `json:"type"`
+	Size       int        `json:"size"`
+	Queue      *QueueInfo `json:"queue,omitempty"`
 }
 
 type Message struct {
@@ -66,34 +71,74 @@ type Message struct {
 type WorkloadReq struct {
 	Filter       string `json:"filter"`
 	WorkloadName string `json:"workload_name"`
+	Mode         string `json:"mode"`
+	Priority     string `json:"priority"`
+	Deadline     string `json:"deadline"`
 }
 
 type Workload struct {
-	Id          uint64   `json:"workload_id"`
-	Filter      string   `json:"filter"`
-	Name        string   `json:"workload_name"`
-	Status      string   `json:"status"`
-	RunningJobs int      `json:"running_jobs"`
-	Images      []uint64 `json:"filtered_images"`
+	Id          uint64            `json:"workload_id"`
+	Filter      string            `json:"filter"`
+	Name        string            `json:"workload_name"`
+	Status      string            `json:"status"`
+	RunningJobs int               `json:"running_jobs"`
+	Images      []uint64          `json:"filtered_images"`
+	Animations  []uint64          `json:"animations,omitempty"`
+	Mode        string            `json:"mode,omitempty"`
+	Priority    string            `json:"priority"` // interactive, normal or batch
+	Sequence    *SequenceProgress `json:"sequence,omitempty"`
+	Pending     []PendingImage    `json:"pending_images,omitempty"`
+	Dropped     []uint64          `json:"dropped_images,omitempty"` // for the controller
+	Owner       string            `json:"owner"`
+	SharedWith  []string          `json:"shared_with,omitempty"`
+	Action      string            `json:"action,omitempty"` // for the controller
+	Backlog     int               `json:"backlog"`          // images waiting
+	Deadline    *time.Time        `json:"deadline,omitempty"`
+	Eta         *time.Time        `json:"eta,omitempty"`     // see estimate
+	AtRisk      bool              `json:"at_risk,omitempty"` // eta after deadline
+}
+
+// PendingImage is an image the controller has to create a job for,
+// they are only sent in the workloads pushed to the controller
+type PendingImage struct {
+	Id     uint64 `json:"image_id"`
+	Filter string `json:"filter,omitempty"` // overrides the workload's
+	Pixels uint64 `json:"pixels,omitempty"` // the scheduler uses it for the timeout
 }
 
 type ImageResp struct {
-	WorkloadId uint64 `json:"workload_id"`
-	Id         uint64 `json:"image_id"`
-	Type       string `json:"type"`
-	Size       int    `json:"size"`
+	WorkloadId uint64    `json:"workload_id"`
+	Id         uint64    `json:"image_id"`
+	Type       string    `json:"type"`
+	Size       int       `json:"size"`
+	Owner      string    `json:"owner"`
+	CreatedAt  time.Time `json:"created_at"`
+	SourceId   uint64    `json:"source_id,omitempty"`
+	Filter     string    `json:"filter,omitempty"`
+	Version    int       `json:"version,omitempty"`
 }
 
 type ImageReq struct {
 	WorkloadId string `json:"workload_id"`
 }
 
-var Users []User /* this will act as our DB */
-var Workloads []Workload
+var Workloads []Workload /* this will act as our DB */
 var Images []Image
 var workloadsIds uint64
 var imagesIds uint64
 
+// the id of an image is given and the image appended with this lock
+// held, that way Images is always sorted by id (searchImage needs it)
+// even with many uploads at the same time. The images are pushed to
+// the controller with it held too, so the ids are in order there
+var imagesLock sync.Mutex
+
+// Workloads is read by the handlers and by the events of the
+// controller at the same time (see notifyWebhooks), it's only read
+// or changed with this lock held (see searchWorkload and
+// changeWorkload). If imagesLock is needed too it's taken first
+var workloadsLock sync.Mutex
+
 /***************** send msg via pipeline ****/
 var workloadsUrl = "tcp://localhost:40899"
 
@@ -113,6 +158,44 @@ func pushMsg(url string, msg string) {
 	time.Sleep(time.Second / 10)
 	sock.Close()
 }
+
+// pushWorkload sends the workload to the controller along with
+// the images that were just added to it, the controller creates
+// one job for each of them. Several images can go in one message.
+// The images are assigned to the workers until they are filtered.
+// Needs imagesLock
+func pushWorkload(workload Workload, pending []uint64) error {
+	var images []PendingImage
+	for _, id := range pending {
+		images = append(images, PendingImage{Id: id})
+	}
+	return pushPending(workload, images)
+}
+
+// pushPending is pushWorkload for images that need a filter that
+// is not the one of the workload (see reprocess)
+func pushPending(workload Workload, pending []PendingImage) error {
+	for i, image := range pending {
+		pending[i].Pixels = pixels(image.Id)
+	}
+	workload.Pending = pending
+	wrkStr, err := json.Marshal(workload)
+	if err != nil {
+		return err
+	}
+	for _, image := range pending {
+		filter := image.Filter
+		if filter == "" {
+			filter = workload.Filter
+		}
+		assign(image.Id, filter)
+	}
+	markPending(workload.Id) // see notifyWebhooks
+	queued(workload.Id, len(pending))
+	pushMsg(workloadsUrl, string(wrkStr))
+	return nil
+}
+
 func die(format string, v ...interface{}) {
 	fmt.Fprintln(os.Stderr, fmt.Sprintf(format, v...))
 	os.Exit(1)
@@ -126,63 +209,56 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INFO]: / requested")
 }
 
-// postLogin will get the hash that's generated by default
-// by the header "Authorization", then it will use it
-// as the token for this particular user.
-// It will also add the user to the "DB" of users, along
-// with it's token
+// postLogin checks the user and password sent in the
+// "Authorization: Basic" header against the registered
+// accounts (see postUsers), if they match it returns a
+// signed access token and a refresh token (see tokens.go),
+// they have nothing to do with the password.
 func postLogin(w http.ResponseWriter, r *http.Request) {
-	var token string
-	var user string
-	var tmp string
-
 	fmt.Println("[INFO]: POST /login requested")
-	user, _, _ = r.BasicAuth() //get username
-	tmp = r.Header.Get("Authorization")
-	token = strings.Fields(tmp)[1] // get the hash from header
-
-	//Build response
-	var login LoginResponse
-	login = LoginResponse{
-		Message: "Hi " + user + ", welcome to the DPIP System",
-		Token:   token,
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		returnError(w, r, 401, "check headers, "+
+			"you must send your user and password (basic auth)")
+		return
+	}
+	account, ok := checkPassword(user, password)
+	if !ok {
+		returnError(w, r, 401, "wrong user or password")
+		return
 	}
 
-	var userInfo User
-	userInfo = User{
-		Username: user,
-		Token:    token,
-		Time:     time.Now().UTC().String(),
+	//Build response
+	login, err := newLogin(account.Username, account.Role)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create token")
+		return
 	}
-	Users = append(Users, userInfo)
+	login.Message = "Hi " + user + ", welcome to the DPIP System"
 
 	json.NewEncoder(w).Encode(login)
 }
 
 // delLogout function will revoke a token from being usable.
 // first it checks if the headers are sent in the correct
-// format, then it will search the token in the Users "DB"
-// if found it will remove it, if not, it will return 400
+// format, then it validates the token and adds it to the
+// revoked tokens, if a refresh_token is sent in the body
+// it gets revoked too
 func delLogout(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INFO]: DELETE /logout requested")
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	index, user, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
+	claims := principal(r) // see authorize
+	revokeToken(claims)
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var refreshReq RefreshReq
+	json.Unmarshal(body, &refreshReq)
+	refresh, err := checkToken(refreshReq.RefreshToken, "refresh")
+	if err == nil && refresh.Subject == claims.Subject {
+		revokeToken(refresh)
 	}
 
-	Users = removeUser(Users, index)
-	returnMsg(w, "Bye "+user.Username+", your token has been revoked")
+	returnMsg(w, "Bye "+claims.Subject+", your token has been revoked")
 }
 
 // based on https://stackoverflow.com/a/40699578
@@ -190,37 +266,20 @@ func delLogout(w http.ResponseWriter, r *http.Request) {
 // It first checks the headers and find the token,
 // validates it and finds the user.
 // Then creates a buffer, copy the bytes of the image
-// to it and fills the Image struct.
-// After that it append the image to the Image slice
-// the user has.
+// to it and fills the Image struct, the user is the owner.
 
 // it also send the updated workload information to the
 // controller this way, the controller knows not just
 // the workloads but the images in them aswell
 func postImages(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INFO]: POST /images requested")
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	index, user, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
-	}
+	claims := principal(r) // see authorize
 
 	// uploading the file part
 	r.ParseMultipartForm(32 << 20) // limit your max input length!
 	file, _, err := r.FormFile("data")
 	if err != nil {
-		w.WriteHeader(400)
-		returnMsg(w, err.Error())
+		returnError(w, r, 400, err.Error())
 		return
 	}
 	defer file.Close()
@@ -229,46 +288,124 @@ func postImages(w http.ResponseWriter, r *http.Request) {
 	wrkId := r.FormValue("workload_id")
 	imgType := r.FormValue("type")
 	if imgType == "" {
-		w.WriteHeader(400)
-		returnMsg(w, "the form sent is missing workload_id or type")
+		returnError(w, r, 400, "the form sent is missing workload_id or type")
 		return
 	}
 
-	// validate id
+	// validate id, filtered images take the workload of the original
 	workloadId, err := strconv.ParseUint(wrkId, 10, 64)
-	if workloadId >= workloadsIds || workloadsIds == 0 {
-		w.WriteHeader(400)
-		returnMsg(w, "the workload id doesnt exists, "+
+	if imgType != "filtered" && !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "the workload id doesnt exists, "+
 			"please check again, you may have to create a workload first."+
 			" If you have, then check that the id you sent is in fact correct")
 		return
 	}
 	// validate type
 	if imgType != "original" && imgType != "filtered" {
-		w.WriteHeader(400)
-		returnMsg(w, "the type sent isnt valid, "+
+		returnError(w, r, 400, "the type sent isnt valid, "+
 			"try with original or filtered")
 		return
 	}
+	if imgType == "original" && !acceptsImages(w, r, workloadId) {
+		return
+	}
+
+	// sequence workloads need to know the position of each frame
+	workload, _ := searchWorkload(workloadId)
+	sequence := imgType == "original" && workload.Mode == "sequence"
+	var frame int
+	if sequence {
+		frame, err = strconv.Atoi(r.FormValue("frame"))
+		if err != nil || frame < 0 {
+			returnError(w, r, 400, "this is a sequence workload, "+
+				"send the frame index in the frame field")
+			return
+		}
+		if _, exists := searchFrame(workloadId, frame); exists {
+			returnError(w, r, 409, "frame "+strconv.Itoa(frame)+
+				" was already uploaded to this workload")
+			return
+		}
+	}
 
 	// Copy the image data to my buffer
 	var buf bytes.Buffer
 	io.Copy(&buf, file)
 
+	// animated gifs are split into frames, each frame is a job
+	if imgType == "original" &&
+		http.DetectContentType(buf.Bytes()) == "image/gif" {
+		anim, err := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			returnError(w, r, 400, "couldnt decode gif, "+err.Error())
+			return
+		}
+		if len(anim.Image) > 1 && sequence {
+			returnError(w, r, 400, "animated gifs cant be uploaded to "+
+				"sequence workloads, upload the frames instead")
+			return
+		}
+		if len(anim.Image) > 1 {
+			postAnimation(w, r, workloadId, anim)
+			return
+		}
+	}
+
+	if imgType == "original" && (!checkQuota(w, r, 1, int64(buf.Len())) ||
+		!checkBacklog(w, r)) {
+		return
+	}
+
 	// Fill the image struct
 	var image Image
 	image.WorkloadId = workloadId
-	image.Id = imagesIds
-	imagesIds += 1
 	image.Type = imgType
 	image.Data = buf.Bytes()
 	image.Size = len(image.Data)
+	image.Frame = frame
+	image.Owner = claims.Subject
+	image.CreatedAt = time.Now().UTC()
 
-	Users[index].Images = append(user.Images, image)
-
+	// filtered images are uploaded by the workers, they tell us
+	// which original they come from, the workload is the same
+	if imgType == "filtered" {
+		srcId, err := strconv.ParseUint(r.FormValue("source_id"), 10, 64)
+		_, src, exists := searchImage(srcId)
+		if err != nil || !exists || !canSeeImage(claims, src) {
+			returnError(w, r, 400, "the source_id sent doesnt exists")
+			return
+		}
+		// the scheduler can send a slow job to a second worker, the
+		// first image of the job wins
+		jobId, jobErr := strconv.ParseUint(r.FormValue("job_id"), 10, 64)
+		if jobErr == nil && !claimJob(jobId, srcId) {
+			returnError(w, r, 409, "job "+strconv.FormatUint(jobId, 10)+
+				" already uploaded its image")
+			return
+		}
+		image.WorkloadId = src.WorkloadId
+		image.SourceId = src.Id
+		image.Owner = src.Owner
+		image.Filter = assignedFilter(src.Id)
+		image.Version = len(filteredVersions(src.Id)) + 1
+	}
 	// add image to fake db
+	imagesLock.Lock()
+	image.Id = imagesIds
+	imagesIds += 1
 	Images = append(Images, image)
+	if imgType == "filtered" {
+		imagesLock.Unlock()
+		unassign(image.SourceId)
+		w.WriteHeader(200)
+		returnMsg(w, "image filtered")
+		return
+	}
 
+	// add image to workload's image array
+	workload = changeWorkload(workloadId, func(workload *Workload) {
+		workload.Images = append(workload.Images, image.Id)
+	})
 	var msg ImageMsg
 	msg = ImageMsg{
 		Message:    "An image has been successfully uploaded :)",
@@ -276,34 +413,24 @@ func postImages(w http.ResponseWriter, r *http.Request) {
 		ImageId:    image.Id,
 		Type:       image.Type,
 		Size:       image.Size,
+		Queue:      queueInfo(),
 	}
-	if imgType == "filtered" {
-		w.WriteHeader(200)
-		returnMsg(w, "image filtered")
-		return
-	}
-
-	// add image to workload's image array
-	Workloads[workloadId].Images = append(Workloads[workloadId].Images,
-		image.Id)
-	workload := Workloads[workloadId]
-	// transform to string
-	wrkStr, err := json.Marshal(workload)
+	err = pushWorkload(workload, []uint64{image.Id})
+	imagesLock.Unlock()
 	if err != nil {
-		w.WriteHeader(500)
-		returnMsg(w, "server internal error, "+
+		returnError(w, r, 500, "server internal error, "+
 			"couldnt marshal json")
 		return
 	}
-	pushMsg(workloadsUrl, string(wrkStr))
 
+	// accepted, it still has to wait in the queue
 	buf.Reset()
-	w.WriteHeader(200)
+	w.WriteHeader(202)
 	json.NewEncoder(w).Encode(msg)
 }
 
 // getImages, if function does not receives image id
-// it will return a list of all the images
+// it will return a list of the images (see listImages)
 // if it does it returns the the image with that ID,
 // it wont return a json, it will return the actual
 // bytes of the images, be sure to use `--output` if you are
@@ -311,60 +438,36 @@ func postImages(w http.ResponseWriter, r *http.Request) {
 func getImages(w http.ResponseWriter, r *http.Request) {
 	// handle token
 	fmt.Println("[INFO]: GET /images/ requested")
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	_, _, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
-	}
+	claims := principal(r) // see authorize
 
 	// read path params
 	vars := mux.Vars(r)
 	id := vars["image_id"]
-	// if they dont send any id, we return all the images info
+	// if they dont send any id, we return the images info
 	if id == "" {
-		var imagesResp []ImageResp
-		for _, image := range Images {
-			var tmp ImageResp
-			tmp.WorkloadId = image.WorkloadId
-			tmp.Id = image.Id
-			tmp.Type = image.Type
-			tmp.Size = image.Size
-			imagesResp = append(imagesResp, tmp)
-		}
-		json.NewEncoder(w).Encode(imagesResp)
+		listImages(w, r, claims)
 		return
 	}
 	fmt.Println("[INFO]: GET /images/" + id + " requested")
 
 	intId, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		w.WriteHeader(400)
-		returnMsg(w, "you didnt send a valid number, "+
+		returnError(w, r, 400, "you didnt send a valid number, "+
 			"please check again")
 		return
 
 	}
 
 	// validate id
-	if intId >= imagesIds || imagesIds == 0 {
-		w.WriteHeader(400)
-		returnMsg(w, "the image id doesnt exists")
+	_, image, exists := searchImage(intId)
+	if !exists || !canSeeImage(claims, image) {
+		returnError(w, r, 404, "the image id doesnt exists")
 		return
 	}
 
 	// download images
 	w.WriteHeader(200)
-	w.Write(Images[intId].Data)
+	w.Write(image.Data)
 	return
 
 }
@@ -372,38 +475,34 @@ func getImages(w http.ResponseWriter, r *http.Request) {
 // getStatus, show the status of the account related
 // to the token sent in the header, proper validations
 // are done, and then the creation time, and a msg is
-// returned to the user
+// returned to the user, only the workloads the user
+// can see are shown
 func getStatus(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INFO]: GET /status requested")
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	_, _, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
-	}
+	claims := principal(r) // see authorize
 
 	var status Status
 	hostname, err := os.Hostname()
 	if err != nil {
-		w.WriteHeader(500)
-		returnMsg(w, "internal server error"+
+		returnError(w, r, 500, "internal server error"+
 			"couldn't get server name")
 		return
 	}
 
+	workloadsLock.Lock()
+	all := make([]Workload, len(Workloads))
+	copy(all, Workloads)
+	workloadsLock.Unlock()
+	workloads := []Workload{}
+	for _, workload := range all {
+		if canSee(claims, workload) {
+			workloads = append(workloads, withProgress(workload))
+		}
+	}
 	status = Status{
 		SystemName: hostname,
 		ServerTime: time.Now().String(),
-		Workloads:  Workloads,
+		Workloads:  workloads,
 	}
 
 	json.NewEncoder(w).Encode(status)
@@ -414,21 +513,7 @@ func getStatus(w http.ResponseWriter, r *http.Request) {
 func postWorkloads(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INFO]: POST /workloads requested")
 	// handle token
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	_, _, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
-	}
+	claims := principal(r) // see authorize
 
 	// handle body request
 	body, _ := ioutil.ReadAll(r.Body)
@@ -438,28 +523,56 @@ func postWorkloads(w http.ResponseWriter, r *http.Request) {
 	// check if json sent is correct
 	if workloadreq.Filter == "" ||
 		workloadreq.WorkloadName == "" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, "+
+		returnError(w, r, 400, "bad request, "+
 			"json sent misspelled or missing field")
 		return
 	}
+	if workloadreq.Mode != "" && workloadreq.Mode != "sequence" {
+		returnError(w, r, 400, "the mode sent isnt valid, "+
+			"leave it empty or try with sequence")
+		return
+	}
+	if workloadreq.Priority == "" {
+		workloadreq.Priority = "normal"
+	}
+	if !validPriority(workloadreq.Priority) {
+		returnError(w, r, 400, "the priority sent isnt valid, "+
+			"try with interactive, normal or batch")
+		return
+	}
+	var deadline *time.Time
+	if workloadreq.Deadline != "" {
+		var msg string
+		if deadline, msg = parseDeadline(workloadreq.Deadline); deadline == nil {
+			returnError(w, r, 400, msg)
+			return
+		}
+	}
+	if !checkWorkloadQuota(w, r) {
+		return
+	}
 
 	// create workload struct
 	var workload Workload
-	workload.Id = workloadsIds
-	workloadsIds += 1
 	workload.Filter = workloadreq.Filter
 	workload.Name = workloadreq.WorkloadName
 	workload.Status = "completed"
 	workload.RunningJobs = 0
 	workload.Images = nil
+	workload.Mode = workloadreq.Mode
+	workload.Priority = workloadreq.Priority
+	workload.Deadline = deadline
+	workload.Owner = claims.Subject
+	workloadsLock.Lock()
+	workload.Id = workloadsIds
+	workloadsIds += 1
 	Workloads = append(Workloads, workload)
+	workloadsLock.Unlock()
 
 	// transform to string
 	workloadStr, err := json.Marshal(workload)
 	if err != nil {
-		w.WriteHeader(500)
-		returnMsg(w, "server internal error, "+
+		returnError(w, r, 500, "server internal error, "+
 			"couldnt marshal json")
 		return
 
@@ -475,28 +588,13 @@ func postWorkloads(w http.ResponseWriter, r *http.Request) {
 func getWorkloads(w http.ResponseWriter, r *http.Request) {
 
 	// handle token
-	tmp := r.Header.Get("Authorization")
-	if strings.Fields(tmp)[0] != "Bearer" {
-		w.WriteHeader(400)
-		returnMsg(w, "bad request, check headers "+
-			"you must send a Bearer token")
-		return
-	}
-	token := strings.Fields(tmp)[1] // get the token from header
-	_, _, exists := searchToken(token)
-	if !exists {
-		w.WriteHeader(400)
-		returnMsg(w, "token not found, "+
-			"please provide a valid one")
-		return
-	}
+	claims := principal(r) // see authorize
 
 	// read path params
 	vars := mux.Vars(r)
 	id := vars["workload_id"]
 	if id == "" {
-		w.WriteHeader(400)
-		returnMsg(w, "id missing, "+
+		returnError(w, r, 400, "id missing, "+
 			"you should do smthg like workloads/{workload_id}")
 		return
 	}
@@ -504,22 +602,26 @@ func getWorkloads(w http.ResponseWriter, r *http.Request) {
 
 	intId, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		w.WriteHeader(400)
-		returnMsg(w, "you didnt send a valid number, "+
+		returnError(w, r, 400, "you didnt send a valid number, "+
 			"please check again")
 		return
 
 	}
 
-	if intId >= workloadsIds || workloadsIds == 0 {
-		w.WriteHeader(400)
-		returnMsg(w, "that id doesnt exists, "+
+	if !workloadExists(claims, intId) {
+		returnError(w, r, 404, "that id doesnt exists, "+
 			"please check again")
 		return
 
 	}
 
-	json.NewEncoder(w).Encode(Workloads[intId])
+	workload, _ := searchWorkload(intId)
+	if workload.Mode == "sequence" {
+		progress := sequenceProgress(workload)
+		workload.Sequence = &progress
+	}
+	workload = withProgress(workload)
+	json.NewEncoder(w).Encode(workload)
 }
 
 /********************* Handler Functions ***************************/
@@ -527,38 +629,30 @@ func getWorkloads(w http.ResponseWriter, r *http.Request) {
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodPost:
 		postLogin(w, r) // post
 	case http.MethodPut:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodDelete:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	default:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	}
 
 }
 func handleLogout(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodPost:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodPut:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodDelete:
 		delLogout(w, r) // delete
 	default:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	}
 
 }
@@ -568,15 +662,10 @@ func handleImages(w http.ResponseWriter, r *http.Request) {
 		getImages(w, r) // get
 	case http.MethodPost:
 		postImages(w, r) // post
-	case http.MethodPut:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
 	case http.MethodDelete:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		delImages(w, r) // delete
 	default:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	}
 
 }
@@ -586,17 +675,13 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		getStatus(w, r) //get
 	case http.MethodPost:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodPut:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	case http.MethodDelete:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	default:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	}
 
 }
@@ -607,15 +692,12 @@ func handleWorkloads(w http.ResponseWriter, r *http.Request) {
 		getWorkloads(w, r) //get
 	case http.MethodPost:
 		postWorkloads(w, r) //post
-	case http.MethodPut:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+	case http.MethodPatch:
+		patchWorkloads(w, r) //patch
 	case http.MethodDelete:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		delWorkloads(w, r) //delete
 	default:
-		w.WriteHeader(404)
-		returnMsg(w, "page not found")
+		returnError(w, r, 405, "method not allowed")
 	}
 
 }
@@ -626,42 +708,123 @@ func handleRequests() {
 	// will help us parsing the path params in
 	// the endpoints
 	router := mux.NewRouter().StrictSlash(true)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.Use(authorize, rateLimit)
 
 	router.HandleFunc("/", homePage)
+	router.HandleFunc("/users", handleUsers)
+	router.HandleFunc("/users/{user}", handleUsers)
+	router.HandleFunc("/users/{user}/limits", handleLimits)
+	router.HandleFunc("/me/usage", handleUsage)
+	router.HandleFunc("/workers", handleWorkers)
+	router.HandleFunc("/workers/{user}", handleWorkers)
+	router.HandleFunc("/keys", handleKeys)
+	router.HandleFunc("/keys/{key_id}", handleKeys)
 	router.HandleFunc("/login", handleLogin)
+	router.HandleFunc("/refresh", handleRefresh)
 	router.HandleFunc("/logout", handleLogout)
 	router.HandleFunc("/status", handleStatus)
 	//TODO
 	router.HandleFunc("/workloads", handleWorkloads)
 	router.HandleFunc("/workloads/{workload_id}", handleWorkloads)
+	router.HandleFunc("/workloads/{workload_id}/sequence", handleSequence)
+	router.HandleFunc("/workloads/{workload_id}/archive", handleArchive)
+	router.HandleFunc("/workloads/{workload_id}/share", handleShare)
+	router.HandleFunc("/workloads/{workload_id}/cancel", handleCancel)
+	router.HandleFunc("/workloads/{workload_id}/pause", handlePause)
+	router.HandleFunc("/workloads/{workload_id}/resume", handleResume)
+	router.HandleFunc("/workloads/{workload_id}/events", handleEvents)
+	router.HandleFunc("/webhooks", handleWebhooks)
+	router.HandleFunc("/webhooks/{webhook_id}", handleWebhooks)
+	router.HandleFunc("/webhooks/{webhook_id}/deliveries", handleDeliveries)
 	router.HandleFunc("/images", handleImages)
 	router.HandleFunc("/images/{image_id}", handleImages)
+	router.HandleFunc("/images/{image_id}/reprocess", handleReprocess)
+	router.HandleFunc("/animations/{animation_id}", handleAnimations)
 
 	// no longer usefull
 	//router.HandleFunc("/upload", handleUpload)
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	log.Fatal(http.ListenAndServe(":8080", withRequestId(router)))
 }
 
 /********************* Helper Functions ***************************/
 
-// Search token in Users, returned index, user struct
-// and boolean that tells us if it was found.
-func searchToken(token string) (int, User, bool) {
-	for i, user := range Users {
-		if user.Token == token {
-			return i, user, true
-		}
+// Search image in Images, the slice is always sorted by id
+// so we can do a binary search. Returns index, image struct and
+// boolean that tells us if it was found.
+func searchImage(id uint64) (int, Image, bool) {
+	imagesLock.Lock()
+	defer imagesLock.Unlock()
+	return findImage(id)
+}
+
+// findImage is searchImage for who already has imagesLock
+func findImage(id uint64) (int, Image, bool) {
+	i := sort.Search(len(Images), func(i int) bool {
+		return Images[i].Id >= id
+	})
+	if i < len(Images) && Images[i].Id == id {
+		return i, Images[i], true
 	}
-	var tmp User
+	var tmp Image
 	return -1, tmp, false
 }
 
-// swap the user you want to remove with the
-// last item, return the slice without the last item
-func removeUser(users []User, index int) []User {
-	users[index] = users[len(users)-1]
-	return users[:len(users)-1]
+// pixels of the image, 0 if it cant be decoded. Needs imagesLock
+func pixels(id uint64) uint64 {
+	_, img, exists := findImage(id)
+	if !exists {
+		return 0
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil {
+		return 0
+	}
+	return uint64(config.Width) * uint64(config.Height)
+}
+
+// Search the latest filtered version of an original image
+func searchFiltered(sourceId uint64) (Image, bool) {
+	images := allImages()
+	for i := len(images) - 1; i >= 0; i-- {
+		if images[i].Type == "filtered" && images[i].SourceId == sourceId {
+			return images[i], true
+		}
+	}
+	var tmp Image
+	return tmp, false
+}
+
+// allImages is Images as it is now, it can be read without the
+// lock, Images is never changed in place, the uploads append and
+// the deletes make a new slice
+func allImages() []Image {
+	imagesLock.Lock()
+	defer imagesLock.Unlock()
+	return Images
+}
+
+// searchWorkload returns a copy of the workload, false if the id
+// doesnt exist
+func searchWorkload(id uint64) (Workload, bool) {
+	workloadsLock.Lock()
+	defer workloadsLock.Unlock()
+	if id >= workloadsIds {
+		var tmp Workload
+		return tmp, false
+	}
+	return Workloads[id], true
+}
+
+// changeWorkload calls change with the workload and the lock held,
+// returns how the workload ended up
+func changeWorkload(id uint64, change func(workload *Workload)) Workload {
+	workloadsLock.Lock()
+	defer workloadsLock.Unlock()
+	change(&Workloads[id])
+	return Workloads[id]
 }
 
 func returnMsg(w http.ResponseWriter, msg string) {
@@ -674,5 +837,9 @@ func returnMsg(w http.ResponseWriter, msg string) {
 }
 
 func Start() {
+	clusterKey = loadClusterKey()
+	loadAdmin()
+	go subscribeEvents()
+	go subscribeQueue()
 	handleRequests()
 }
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKey lets scripts (CI, stress_test.py) use the api without
+// logging in, they send it in the X-API-Key header. We only keep
+// the sha256 of the key, the key itself is shown once when it's
+// created. Prefix is there so people can tell their keys apart
+type APIKey struct {
+	Id        string     `json:"key_id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Prefix    string     `json:"prefix"`
+	Hash      string     `json:"-"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used_at,omitempty"`
+}
+
+type APIKeyReq struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"` // seconds, 0 never expires
+}
+
+type APIKeyResp struct {
+	Message string `json:"message"`
+	Key     string `json:"key"`
+	APIKey
+}
+
+// scopes an api key can have, they are checked in authorize,
+// a key without scopes can do everything its owner can
+var validScopes = map[string]bool{
+	"workloads:read":  true,
+	"workloads:write": true,
+	"images:read":     true,
+	"images:write":    true,
+}
+
+var APIKeys []APIKey
+var apiKeysLock sync.Mutex
+
+// postKeys creates an api key for the user, the key is only in
+// this response, we can't show it again
+func postKeys(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: POST /keys requested")
+	claims := principal(r) // see authorize
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var keyReq APIKeyReq
+	if err := json.Unmarshal(body, &keyReq); err != nil {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	for _, scope := range keyReq.Scopes {
+		if !validScopes[scope] {
+			returnError(w, r, 400, "the scope "+scope+" isnt valid, "+
+				"try with workloads:read, workloads:write, "+
+				"images:read or images:write")
+			return
+		}
+	}
+	if keyReq.ExpiresIn < 0 {
+		returnError(w, r, 400, "expires_in must be positive")
+		return
+	}
+
+	secret, err := randomId()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create key")
+		return
+	}
+	id, err := randomId()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create key")
+		return
+	}
+	key := "dpip_" + secret
+
+	var apiKey APIKey
+	apiKey.Id = id[:16]
+	apiKey.Name = keyReq.Name
+	apiKey.Owner = claims.Subject
+	apiKey.Prefix = key[:12]
+	apiKey.Hash = hashKey(key)
+	apiKey.Scopes = keyReq.Scopes
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+	apiKey.CreatedAt = time.Now().UTC()
+	if keyReq.ExpiresIn > 0 {
+		expires := apiKey.CreatedAt.Add(time.Duration(keyReq.ExpiresIn) *
+			time.Second)
+		apiKey.ExpiresAt = &expires
+	}
+
+	apiKeysLock.Lock()
+	APIKeys = append(APIKeys, apiKey)
+	apiKeysLock.Unlock()
+
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(APIKeyResp{
+		Message: "save your key, you wont be able to see it again",
+		Key:     key,
+		APIKey:  apiKey,
+	})
+}
+
+// getKeys lists the keys of the user, without the keys of course
+func getKeys(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /keys requested")
+	claims := principal(r) // see authorize
+
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	keys := []APIKey{}
+	for _, apiKey := range APIKeys {
+		if apiKey.Owner == claims.Subject {
+			keys = append(keys, apiKey)
+		}
+	}
+	json.NewEncoder(w).Encode(keys)
+}
+
+// delKeys revokes a key, it stops working right away
+func delKeys(w http.ResponseWriter, r *http.Request) {
+	claims := principal(r) // see authorize
+	id := mux.Vars(r)["key_id"]
+	fmt.Println("[INFO]: DELETE /keys/" + id + " requested")
+
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	for i, apiKey := range APIKeys {
+		if apiKey.Id == id && apiKey.Owner == claims.Subject {
+			APIKeys = append(APIKeys[:i], APIKeys[i+1:]...)
+			returnMsg(w, "the key "+apiKey.Prefix+"... has been revoked")
+			return
+		}
+	}
+	returnError(w, r, 404, "the key id doesnt exists")
+}
+
+func handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getKeys(w, r) // get
+	case http.MethodPost:
+		postKeys(w, r) // post
+	case http.MethodDelete:
+		delKeys(w, r) // delete
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkAPIKey looks the key up by its hash and returns claims
+// like the ones in the tokens, with the scopes of the key
+func checkAPIKey(key string) (Claims, error) {
+	var claims Claims
+	hash := hashKey(key)
+
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	for i, apiKey := range APIKeys {
+		if apiKey.Hash != hash {
+			continue
+		}
+		now := time.Now().UTC()
+		if apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt) {
+			return claims, errors.New("api key expired, " +
+				"create a new one in POST /keys")
+		}
+		APIKeys[i].LastUsed = &now
+
+		account, _ := searchAccount(apiKey.Owner)
+		claims.Subject = apiKey.Owner
+		claims.Role = account.Role
+		claims.Type = "apikey"
+		claims.Id = apiKey.Id
+		claims.Scopes = apiKey.Scopes
+		return claims, nil
+	}
+	return claims, errors.New("api key not valid, " +
+		"please provide a valid one")
+}
+
+// removeKeys revokes all the keys of a user
+func removeKeys(username string) {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	var keys []APIKey
+	for _, apiKey := range APIKeys {
+		if apiKey.Owner != username {
+			keys = append(keys, apiKey)
+		}
+	}
+	APIKeys = keys
+}
@@ -0,0 +1,490 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // so DecodeConfig knows about jpegs
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ArchiveMsg struct {
+	Message    string     `json:"message"`
+	WorkloadId uint64     `json:"workload_id"`
+	Images     []uint64   `json:"images"`
+	Queue      *QueueInfo `json:"queue,omitempty"` // of the first image
+}
+
+// Manifest goes as manifest.json inside the downloaded archives
+type Manifest struct {
+	WorkloadId uint64          `json:"workload_id"`
+	Name       string          `json:"workload_name"`
+	Filter     string          `json:"filter"`
+	Files      []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	File     string `json:"file"`
+	ImageId  uint64 `json:"image_id"`
+	Type     string `json:"type"`
+	SourceId uint64 `json:"source_id,omitempty"`
+	Frame    int    `json:"frame"`
+	Size     int    `json:"size"`
+}
+
+// archiveEntry is a file read from an uploaded zip or tar
+type archiveEntry struct {
+	Name string
+	Data []byte
+}
+
+// bulk uploads bigger than this are rejected. The other two limits
+// are for what comes out of the archive, a small zip can have a huge
+// file inside and everything is read into memory
+var maxArchiveSize int64 = 1 << 30
+var maxEntrySize int64 = 64 << 20    // each file
+var maxExtractedSize int64 = 1 << 30 // all of them together
+
+var errTooBig = errors.New("too big")
+
+// used to get the frame index out of names like 12.png or frame_0012.png
+var frameName = regexp.MustCompile(`(\d+)$`)
+
+// postArchive uploads a zip, tar or tar.gz (sent as the request
+// body) full of images to a workload. Every entry is validated
+// before anything is stored, if one is wrong nothing is added.
+// Then all the images go to the controller in a single message.
+func postArchive(w http.ResponseWriter, r *http.Request) {
+	claims := principal(r) // see authorize
+
+	// read path params
+	vars := mux.Vars(r)
+	id := vars["workload_id"]
+	fmt.Println("[INFO]: POST /workloads/" + id + "/archive requested")
+	workloadId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	if !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "the workload id doesnt exists, "+
+			"please check again")
+		return
+	}
+	if !acceptsImages(w, r, workloadId) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxArchiveSize)
+	entries, err := readArchive(r.Body)
+	var maxBytes *http.MaxBytesError
+	if errors.Is(err, errTooBig) || errors.As(err, &maxBytes) {
+		returnError(w, r, 413, "the archive is too big: "+err.Error())
+		return
+	}
+	if err != nil {
+		returnError(w, r, 400, "couldnt read the archive, "+
+			"send a zip, tar or tar.gz: "+err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		returnError(w, r, 400, "the archive doesnt have any image")
+		return
+	}
+
+	// validate every entry before touching the db
+	workload, _ := searchWorkload(workloadId)
+	sequence := workload.Mode == "sequence"
+	frames := make([]int, len(entries))
+	seen := make(map[int]string)
+	for i, entry := range entries {
+		if _, _, err := image.DecodeConfig(
+			bytes.NewReader(entry.Data)); err != nil {
+			returnError(w, r, 400, entry.Name+" is not a valid image, "+
+				"nothing was uploaded")
+			return
+		}
+		if !sequence {
+			continue
+		}
+		frame, ok := frameFromName(entry.Name)
+		if !ok {
+			returnError(w, r, 400, "this is a sequence workload, "+
+				entry.Name+" doesnt have a frame number in its name")
+			return
+		}
+		if other, exists := seen[frame]; exists {
+			returnError(w, r, 400, entry.Name+" and "+other+
+				" are the same frame, nothing was uploaded")
+			return
+		}
+		if _, exists := searchFrame(workloadId, frame); exists {
+			returnError(w, r, 409, "frame "+strconv.Itoa(frame)+
+				" was already uploaded to this workload")
+			return
+		}
+		seen[frame] = entry.Name
+		frames[i] = frame
+	}
+
+	var size int64
+	for _, entry := range entries {
+		size += int64(len(entry.Data))
+	}
+	if !checkQuota(w, r, len(entries), size) || !checkBacklog(w, r) {
+		return
+	}
+
+	// register all of them, the lock is held until they are pushed
+	// so their ids are in order everywhere
+	var ids []uint64
+	imagesLock.Lock()
+	for i, entry := range entries {
+		var image Image
+		image.WorkloadId = workloadId
+		image.Id = imagesIds
+		imagesIds += 1
+		image.Type = "original"
+		image.Data = entry.Data
+		image.Size = len(entry.Data)
+		image.Frame = frames[i]
+		image.Owner = claims.Subject
+		image.CreatedAt = time.Now().UTC()
+
+		Images = append(Images, image)
+		ids = append(ids, image.Id)
+	}
+	workload = changeWorkload(workloadId, func(workload *Workload) {
+		workload.Images = append(workload.Images, ids...)
+	})
+	queue := queueInfo()
+	err = pushWorkload(workload, ids)
+	imagesLock.Unlock()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+
+	var msg ArchiveMsg
+	msg = ArchiveMsg{
+		Message: fmt.Sprintf("%d images have been successfully "+
+			"uploaded :)", len(ids)),
+		WorkloadId: workloadId,
+		Images:     ids,
+		Queue:      queue,
+	}
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// getArchive streams a zip (or a tar with ?format=tar) with the
+// images of a workload, ?include=original, filtered or all (the
+// default). Files are named after their type and id, e.g.
+// filtered/7.png, and a manifest.json with the details of every
+// file goes first. Each image is written as soon as it's read,
+// the archive is never built in memory.
+func getArchive(w http.ResponseWriter, r *http.Request) {
+	claims := principal(r) // see authorize
+
+	// read path params
+	vars := mux.Vars(r)
+	id := vars["workload_id"]
+	fmt.Println("[INFO]: GET /workloads/" + id + "/archive requested")
+	workloadId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	if !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "the workload id doesnt exists, "+
+			"please check again")
+		return
+	}
+
+	// read query params
+	include := r.URL.Query().Get("include")
+	if include == "" {
+		include = "all"
+	}
+	if include != "all" && include != "original" && include != "filtered" {
+		returnError(w, r, 400, "the include sent isnt valid, "+
+			"try with all, original or filtered")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		returnError(w, r, 400, "the format sent isnt valid, "+
+			"try with zip or tar")
+		return
+	}
+
+	workload, _ := searchWorkload(workloadId)
+	var manifest Manifest
+	manifest.WorkloadId = workload.Id
+	manifest.Name = workload.Name
+	manifest.Filter = workload.Filter
+	var images []Image
+	for _, image := range allImages() {
+		if image.WorkloadId != workloadId {
+			continue
+		}
+		if include != "all" && image.Type != include {
+			continue
+		}
+		images = append(images, image)
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			File:     archiveName(image),
+			ImageId:  image.Id,
+			Type:     image.Type,
+			SourceId: image.SourceId,
+			Frame:    image.Frame,
+			Size:     image.Size,
+		})
+	}
+	manifestStr, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+
+	filename := fmt.Sprintf("workload-%d.%s", workloadId, format)
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=\""+filename+"\"")
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.WriteHeader(200)
+		writeTar(w, manifestStr, images)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(200)
+	writeZip(w, manifestStr, images)
+}
+
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getArchive(w, r) // get
+	case http.MethodPost:
+		postArchive(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// readArchive checks the first bytes of the body to know if it's
+// a zip, a gzipped tar or a plain tar and returns its files.
+// Directories and hidden files (.DS_Store, __MACOSX/...) are skipped
+func readArchive(body io.Reader) ([]archiveEntry, error) {
+	reader := bufio.NewReader(body)
+	magic, _ := reader.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return readZip(reader)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readTar(gz)
+	default:
+		return readTar(reader)
+	}
+}
+
+// readEntry reads one file of the archive, it fails if the file or
+// the total read so far go over the limits
+func readEntry(reader io.Reader, name string, total *int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxEntrySize {
+		return nil, fmt.Errorf("%s is bigger than %d bytes: %w",
+			name, maxEntrySize, errTooBig)
+	}
+	*total += int64(len(data))
+	if *total > maxExtractedSize {
+		return nil, fmt.Errorf("the files add up to more than %d "+
+			"bytes: %w", maxExtractedSize, errTooBig)
+	}
+	return data, nil
+}
+
+func readTar(reader io.Reader) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	var total int64
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || hiddenEntry(header.Name) {
+			continue
+		}
+		data, err := readEntry(archive, header.Name, &total)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{header.Name, data})
+	}
+	return entries, nil
+}
+
+// zip files need random access, so the body is written to a
+// temporary file first
+func readZip(reader io.Reader) ([]archiveEntry, error) {
+	file, err := ioutil.TempFile("", "dpip-archive-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []archiveEntry
+	var total int64
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || hiddenEntry(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := readEntry(rc, f.Name, &total)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{f.Name, data})
+	}
+	return entries, nil
+}
+
+// once the headers are sent there's nothing to answer to the
+// client, so the writers just log the errors and stop
+func writeZip(w io.Writer, manifest []byte, images []Image) {
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	entry, err := archive.Create("manifest.json")
+	if err == nil {
+		_, err = entry.Write(manifest)
+	}
+	for i := 0; err == nil && i < len(images); i++ {
+		entry, err = archive.Create(archiveName(images[i]))
+		if err == nil {
+			_, err = entry.Write(images[i].Data)
+		}
+	}
+	if err != nil {
+		fmt.Println("[ERROR] couldnt write zip archive: " + err.Error())
+	}
+}
+
+func writeTar(w io.Writer, manifest []byte, images []Image) {
+	archive := tar.NewWriter(w)
+	defer archive.Close()
+
+	now := time.Now()
+	err := writeTarEntry(archive, "manifest.json", manifest, now)
+	for i := 0; err == nil && i < len(images); i++ {
+		err = writeTarEntry(archive, archiveName(images[i]),
+			images[i].Data, now)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] couldnt write tar archive: " + err.Error())
+	}
+}
+
+func writeTarEntry(archive *tar.Writer, name string, data []byte,
+	modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// name of an image inside a downloaded archive, type/id.ext
+func archiveName(image Image) string {
+	ext := ".png"
+	switch http.DetectContentType(image.Data) {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/gif":
+		ext = ".gif"
+	}
+	return image.Type + "/" + strconv.FormatUint(image.Id, 10) + ext
+}
+
+func hiddenEntry(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".") ||
+		strings.HasPrefix(name, "__MACOSX/")
+}
+
+// frameFromName returns the number at the end of a file name,
+// without the extension
+func frameFromName(name string) (int, bool) {
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	match := frameName.FindString(base)
+	if match == "" {
+		return 0, false
+	}
+	frame, err := strconv.Atoi(match)
+	if err != nil {
+		return 0, false
+	}
+	return frame, true
+}
@@ -0,0 +1,232 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// files of the test archives, in order
+type testFile struct {
+	name string
+	data string
+}
+
+func testZip(files []testFile) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		entry, _ := archive.Create(file.name)
+		entry.Write([]byte(file.data))
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func testTar(files []testFile) []byte {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	archive.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir,
+		Mode: 0755})
+	for _, file := range files {
+		writeTarEntry(archive, file.name, []byte(file.data), time.Now())
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func testTarGz(files []testFile) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(testTar(files))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestReadArchive(t *testing.T) {
+	files := []testFile{
+		{"1.png", "one"},
+		{"dir/frame_0002.png", "two"},
+		{".DS_Store", "hidden"},
+		{"dir/._1.png", "hidden"},
+		{"__MACOSX/1.png", "hidden"},
+	}
+	want := []archiveEntry{
+		{"1.png", []byte("one")},
+		{"dir/frame_0002.png", []byte("two")},
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"zip", testZip(files)},
+		{"tar", testTar(files)},
+		{"tar.gz", testTarGz(files)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := readArchive(bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("got %v, want %v", entries, want)
+			}
+		})
+	}
+
+	t.Run("not an archive", func(t *testing.T) {
+		_, err := readArchive(bytes.NewReader(
+			bytes.Repeat([]byte("garbage "), 100)))
+		if err == nil {
+			t.Error("no error")
+		}
+	})
+}
+
+func TestReadArchiveLimits(t *testing.T) {
+	oldEntry, oldExtracted := maxEntrySize, maxExtractedSize
+	maxEntrySize, maxExtractedSize = 10, 25
+	t.Cleanup(func() {
+		maxEntrySize, maxExtractedSize = oldEntry, oldExtracted
+	})
+
+	tests := []struct {
+		name  string
+		files []testFile
+		big   bool
+	}{
+		{"fits", []testFile{{"1.png", "0123456789"},
+			{"2.png", "0123456789"}, {"3.png", "01234"}}, false},
+		{"one file too big", []testFile{{"1.png", "01234567890"}}, true},
+		{"too much together", []testFile{{"1.png", "0123456789"},
+			{"2.png", "0123456789"}, {"3.png", "012345"}}, true},
+		{"hidden ones dont count", []testFile{{"1.png", "0123456789"},
+			{".big", "0123456789012345678901234567890"}}, false},
+	}
+	for _, test := range tests {
+		for format, body := range map[string][]byte{
+			"zip":    testZip(test.files),
+			"tar.gz": testTarGz(test.files),
+		} {
+			t.Run(test.name+" "+format, func(t *testing.T) {
+				_, err := readArchive(bytes.NewReader(body))
+				if test.big && !errors.Is(err, errTooBig) {
+					t.Errorf("got %v, want %v", err, errTooBig)
+				}
+				if !test.big && err != nil {
+					t.Errorf("got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestFrameFromName(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame int
+		ok    bool
+	}{
+		{"12.png", 12, true},
+		{"frame_0012.png", 12, true},
+		{"dir/7/frame3.jpg", 3, true},
+		{"0.gif", 0, true},
+		{"cover.png", 0, false},
+		{"12-final.png", 0, false},
+	}
+	for _, test := range tests {
+		frame, ok := frameFromName(test.name)
+		if frame != test.frame || ok != test.ok {
+			t.Errorf("%s: got %d %v, want %d %v", test.name, frame, ok,
+				test.frame, test.ok)
+		}
+	}
+}
+
+func TestPostArchive(t *testing.T) {
+	resetState(t)
+	controller := testController(t)
+	setAccounts(Account{Username: "ana", Role: roleUser})
+	Workloads = []Workload{
+		{Id: 0, Filter: "blur", Owner: "ana", Status: "scheduling"},
+		{Id: 1, Filter: "blur", Owner: "ana", Status: "scheduling",
+			Mode: "sequence"},
+	}
+	workloadsIds = 2
+	png := string(testPng())
+
+	tests := []struct {
+		name     string
+		workload string
+		body     []byte
+		status   int
+		images   int // added to the db
+	}{
+		{"zip", "0", testZip([]testFile{{"a.png", png},
+			{"b.png", png}}), 202, 2},
+		{"not an image", "0", testZip([]testFile{{"a.png", png},
+			{"b.png", "not a png"}}), 400, 0},
+		{"empty", "0", testZip([]testFile{{".DS_Store", png}}), 400, 0},
+		{"frames", "1", testTarGz([]testFile{{"frame_1.png", png},
+			{"frame_2.png", png}}), 202, 2},
+		{"frame without number", "1", testTarGz([]testFile{
+			{"cover.png", png}}), 400, 0},
+		{"same frame twice", "1", testTarGz([]testFile{{"5.png", png},
+			{"dir/005.png", png}}), 400, 0},
+		{"frame already uploaded", "1", testTarGz([]testFile{
+			{"frame_3.png", png}, {"frame_2.png", png}}), 409, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(allImages())
+			r := httptest.NewRequest("POST", "/workloads/"+test.workload+
+				"/archive", bytes.NewReader(test.body))
+			r = mux.SetURLVars(withPrincipal(r, Claims{Subject: "ana",
+				Role: roleUser}), map[string]string{
+				"workload_id": test.workload})
+			w := httptest.NewRecorder()
+			postArchive(w, r)
+			if w.Code != test.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.status,
+					w.Body.String())
+			}
+			if added := len(allImages()) - before; added != test.images {
+				t.Errorf("%d images added, want %d", added, test.images)
+			}
+			if test.status != 202 {
+				return
+			}
+			if _, err := controller.Recv(); err != nil {
+				t.Fatalf("nothing was pushed: %v", err)
+			}
+		})
+	}
+
+	t.Run("too big", func(t *testing.T) {
+		old := maxEntrySize
+		maxEntrySize = 10
+		t.Cleanup(func() { maxEntrySize = old })
+		r := httptest.NewRequest("POST", "/workloads/0/archive",
+			bytes.NewReader(testZip([]testFile{{"a.png", png}})))
+		r = mux.SetURLVars(withPrincipal(r, Claims{Subject: "ana",
+			Role: roleUser}), map[string]string{"workload_id": "0"})
+		w := httptest.NewRecorder()
+		postArchive(w, r)
+		if w.Code != 413 {
+			t.Errorf("got %d, want 413", w.Code)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/sub"
+)
+
+// QueueStats is what the scheduler publishes every second (see
+// scheduler/backpressure.go)
+type QueueStats struct {
+	Depth    int       `json:"depth"`
+	Paused   int       `json:"paused"`
+	Running  int       `json:"running"`
+	Workers  int       `json:"workers"`
+	WaitMs   int64     `json:"wait_ms"`
+	JobMs    int64     `json:"job_ms"`
+	Dequeued uint64    `json:"dequeued"` // jobs that left the queue
+	Time     time.Time `json:"time"`
+}
+
+// QueueInfo goes in the 202 of the uploads, where the first image
+// is in the queue and how long until a worker takes it
+type QueueInfo struct {
+	Position        int   `json:"position"`
+	EstimatedWaitMs int64 `json:"estimated_wait_ms"`
+}
+
+var queueStatsUrl = "tcp://localhost:40906"
+
+var queueStats QueueStats
+var pushedSince int // images sent after the last stats
+var queueStatsLock sync.Mutex
+
+// where the last image sent of each workload went in the queue and
+// how many jobs had left the queue then, the difference with
+// QueueStats.Dequeued is how many are still ahead (see estimate)
+type queueMark struct {
+	position int
+	dequeued uint64
+}
+
+var marks = make(map[uint64]queueMark) // by workload, queueStatsLock
+
+// above this many jobs waiting uploads get 503
+var maxBacklog = loadMaxBacklog()
+
+// if the scheduler stopped sending stats we dont know, and we
+// dont stop the uploads
+var statsMaxAge = 5 * time.Second
+
+func loadMaxBacklog() int {
+	if value, err := strconv.Atoi(os.Getenv("DPIP_MAX_BACKLOG")); err == nil &&
+		value > 0 {
+		return value
+	}
+	return 1000
+}
+
+// checkBacklog answers 503 with Retry-After when the scheduler has
+// more than maxBacklog jobs waiting, the images would just pile up
+// in memory. The paused ones dont count, they dont take workers
+func checkBacklog(w http.ResponseWriter, r *http.Request) bool {
+	queueStatsLock.Lock()
+	stats := queueStats
+	waiting := stats.Depth - stats.Paused + pushedSince
+	queueStatsLock.Unlock()
+	if time.Since(stats.Time) > statsMaxAge || waiting < maxBacklog {
+		return true
+	}
+
+	seconds := int(math.Ceil(float64(stats.WaitMs) / 1000))
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > 300 {
+		seconds = 300
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	returnError(w, r, 503, fmt.Sprintf("the workers are busy, %d images "+
+		"are waiting, try again in %d seconds", waiting, seconds))
+	return false
+}
+
+// queueInfo is where the next image will be, nil if we dont know.
+// The wait is the one of the scheduler plus the images sent after
+// its stats
+func queueInfo() *QueueInfo {
+	queueStatsLock.Lock()
+	defer queueStatsLock.Unlock()
+	if time.Since(queueStats.Time) > statsMaxAge {
+		return nil
+	}
+	workers := queueStats.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	return &QueueInfo{
+		Position: queueStats.Depth - queueStats.Paused + pushedSince + 1,
+		EstimatedWaitMs: queueStats.WaitMs +
+			int64(pushedSince)*queueStats.JobMs/int64(workers),
+	}
+}
+
+// queued counts the images sent to the controller since the last
+// stats, so the backlog is right between them, and marks where the
+// last one of the workload is
+func queued(workloadId uint64, images int) {
+	queueStatsLock.Lock()
+	defer queueStatsLock.Unlock()
+	pushedSince += images
+	marks[workloadId] = queueMark{
+		position: queueStats.Depth - queueStats.Paused + pushedSince,
+		dequeued: queueStats.Dequeued,
+	}
+}
+
+// PUBSUB receive the stats of the queue of the scheduler
+func subscribeQueue() {
+	var sock mangos.Socket
+	var err error
+	var msg []byte
+
+	if sock, err = sub.NewSocket(); err != nil {
+		die("can't get new sub socket: %s", err.Error())
+	}
+	sock.SetOption(mangos.OptionDialAsynch, true)
+	if err = sock.Dial(queueStatsUrl); err != nil {
+		die("can't dial on sub socket: %s", err.Error())
+	}
+	if err = sock.SetOption(mangos.OptionSubscribe, []byte("")); err != nil {
+		die("can't subscribe: %s", err.Error())
+	}
+	for {
+		msg, err = sock.Recv()
+		if err != nil {
+			die("cannot receive from mangos Socket: %s", err.Error())
+		}
+		var stats QueueStats
+		if err = json.Unmarshal(msg, &stats); err != nil {
+			fmt.Println("[ERROR] api couldnt parse queue stats")
+			continue
+		}
+		queueStatsLock.Lock()
+		queueStats = stats
+		pushedSince = 0
+		queueStatsLock.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckBacklog(t *testing.T) {
+	resetState(t)
+	tests := []struct {
+		name       string
+		stats      QueueStats
+		stale      bool
+		status     int // 0 if it lets the upload in
+		retryAfter string
+	}{
+		{"empty queue", QueueStats{}, false, 0, ""},
+		{"under the limit", QueueStats{Depth: maxBacklog - 1}, false, 0, ""},
+		{"full", QueueStats{Depth: maxBacklog, WaitMs: 2500}, false, 503,
+			"3"},
+		{"paused dont count", QueueStats{Depth: maxBacklog + 10,
+			Paused: 20}, false, 0, ""},
+		{"at least a second", QueueStats{Depth: maxBacklog}, false, 503,
+			"1"},
+		{"at most 5 minutes", QueueStats{Depth: maxBacklog,
+			WaitMs: 3600000}, false, 503, "300"},
+		{"old stats", QueueStats{Depth: maxBacklog}, true, 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			freshStats(test.stats)
+			if test.stale {
+				queueStatsLock.Lock()
+				queueStats.Time = time.Now().Add(-time.Minute)
+				queueStatsLock.Unlock()
+			}
+			r := httptest.NewRequest("POST", "/images", nil)
+			w := httptest.NewRecorder()
+			ok := checkBacklog(w, r)
+			if ok != (test.status == 0) {
+				t.Fatalf("ok = %v, want %v", ok, test.status == 0)
+			}
+			if ok {
+				return
+			}
+			if w.Code != test.status {
+				t.Errorf("got %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, test.retryAfter)
+			}
+		})
+	}
+}
+
+func TestUploadStatus(t *testing.T) {
+	resetState(t)
+	controller := testController(t)
+
+	setAccounts(Account{Username: "ana", Role: roleUser},
+		Account{Username: "pedro", Role: roleWorker})
+	Workloads = []Workload{{Id: 0, Filter: "blur", Owner: "ana",
+		Status: "scheduling"}}
+	workloadsIds = 1
+	ana := Claims{Subject: "ana", Role: roleUser}
+	pedro := Claims{Subject: "pedro", Role: roleWorker}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		fields map[string]string
+		stats  QueueStats
+		status int
+		pushed bool
+	}{
+		{"original waits in the queue", ana, map[string]string{
+			"workload_id": "0", "type": "original"}, QueueStats{}, 202,
+			true},
+		{"filtered by the worker", pedro, map[string]string{
+			"type": "filtered", "source_id": "0", "job_id": "0"},
+			QueueStats{}, 200, false},
+		{"queue is full", ana, map[string]string{
+			"workload_id": "0", "type": "original"},
+			QueueStats{Depth: maxBacklog, WaitMs: 1000}, 503, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			freshStats(test.stats)
+			status := upload(testPng(), test.claims, test.fields)
+			if status != test.status {
+				t.Fatalf("got %d, want %d", status, test.status)
+			}
+			_, err := controller.Recv()
+			if pushed := err == nil; pushed != test.pushed {
+				t.Errorf("pushed = %v, want %v", pushed, test.pushed)
+			}
+		})
+	}
+	if images := len(Images); images != 2 {
+		t.Errorf("%d images, want 2 (the original and its filtered)",
+			images)
+	}
+}
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// how long a job of each filter takes, learned from the job-finished
+// events (see subscribeEvents). It's a moving average so it follows
+// the workers getting faster or slower
+type throughput struct {
+	avgMs   float64
+	samples int
+}
+
+var filterStats = make(map[string]*throughput)
+var filterStatsLock sync.Mutex
+
+// weight of the last job in the average
+var smoothing = 0.2
+
+// recordJob adds the duration of a finished job to the average of
+// its filter
+func recordJob(event Event) {
+	if event.Type != "job-finished" || event.DurationMs <= 0 {
+		return
+	}
+	filterStatsLock.Lock()
+	defer filterStatsLock.Unlock()
+	stats, exists := filterStats[event.Filter]
+	if !exists {
+		filterStats[event.Filter] = &throughput{
+			avgMs:   float64(event.DurationMs),
+			samples: 1,
+		}
+		return
+	}
+	stats.avgMs = smoothing*float64(event.DurationMs) +
+		(1-smoothing)*stats.avgMs
+	stats.samples += 1
+}
+
+// estimate is when the workload should be done. The jobs that go
+// before its last image are the ones ahead of it in the queue (see
+// queued) plus the running ones, they are split between the live
+// workers and each one takes what a job of the filter usually takes
+// (what any job takes if we haven't seen that filter yet). Without
+// stats from the scheduler or without workers there's no estimate
+func estimate(workload Workload, waiting int) (time.Time, bool) {
+	now := time.Now().UTC()
+	if waiting == 0 {
+		return now, true
+	}
+	queueStatsLock.Lock()
+	stats := queueStats
+	mark, marked := marks[workload.Id]
+	queueStatsLock.Unlock()
+	if time.Since(stats.Time) > statsMaxAge || stats.Workers == 0 {
+		return time.Time{}, false
+	}
+
+	avgMs := float64(stats.JobMs)
+	filterStatsLock.Lock()
+	if tmp, exists := filterStats[workload.Filter]; exists {
+		avgMs = tmp.avgMs
+	}
+	filterStatsLock.Unlock()
+
+	jobs := waiting
+	if marked && stats.Dequeued >= mark.dequeued {
+		// our last image is still in the queue, everything ahead
+		// and what is running goes first
+		ahead := mark.position - int(stats.Dequeued-mark.dequeued)
+		if ahead > 0 && ahead+stats.Running > jobs {
+			jobs = ahead + stats.Running
+		}
+	}
+	rounds := math.Ceil(float64(jobs) / float64(stats.Workers))
+	return now.Add(time.Duration(rounds*avgMs) * time.Millisecond), true
+}
+
+// withProgress fills the fields that are calculated when asked,
+// the backlog, the eta and if it's going to miss its deadline
+func withProgress(workload Workload) Workload {
+	workload.Backlog = backlog(workload)
+	workload.Eta = nil
+	workload.AtRisk = false
+	if !isActive(workload) || workload.Status == "paused" {
+		// paused workloads dont move, there's no eta
+		if workload.Deadline != nil && workload.Backlog > 0 {
+			workload.AtRisk = time.Now().After(*workload.Deadline)
+		}
+		return workload
+	}
+	eta, ok := estimate(workload, workload.Backlog)
+	if ok {
+		workload.Eta = &eta
+	}
+	if workload.Deadline != nil && workload.Backlog > 0 {
+		workload.AtRisk = time.Now().After(*workload.Deadline) ||
+			(ok && eta.After(*workload.Deadline))
+	}
+	return workload
+}
+
+// parseDeadline reads the deadline sent by the user, it has to be
+// RFC 3339 (2021-06-01T18:00:00Z) and in the future
+func parseDeadline(deadline string) (*time.Time, string) {
+	parsed, err := time.Parse(time.RFC3339, deadline)
+	if err != nil {
+		return nil, "the deadline sent isnt valid, " +
+			"use RFC 3339 like 2021-06-01T18:00:00Z"
+	}
+	if !parsed.After(time.Now()) {
+		return nil, "the deadline already passed"
+	}
+	parsed = parsed.UTC()
+	return &parsed, ""
+}
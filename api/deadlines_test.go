@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	resetState(t)
+	filterStatsLock.Lock()
+	filterStats = map[string]*throughput{"blur": {avgMs: 500, samples: 3}}
+	filterStatsLock.Unlock()
+
+	fresh := QueueStats{Workers: 2, Running: 2, JobMs: 1000,
+		Dequeued: 10}
+	marked := map[uint64]queueMark{0: {position: 20, dequeued: 10}}
+
+	tests := []struct {
+		name     string
+		stats    QueueStats
+		stale    bool
+		marks    map[uint64]queueMark
+		filter   string
+		waiting  int
+		ok       bool
+		expected time.Duration
+	}{
+		{"nothing waiting", fresh, false, nil, "grayscale", 0, true, 0},
+		{"no stats", fresh, true, nil, "grayscale", 4, false, 0},
+		{"no workers", QueueStats{JobMs: 1000}, false, nil,
+			"grayscale", 4, false, 0},
+		{"any job time", fresh, false, nil, "grayscale", 4, true,
+			2 * time.Second},
+		{"filter time", fresh, false, nil, "blur", 4, true, time.Second},
+		{"queue ahead and running", fresh, false, marked, "grayscale",
+			4, true, 11 * time.Second},
+		{"part of the queue left", QueueStats{Workers: 2, Running: 2,
+			JobMs: 1000, Dequeued: 25}, false, marked, "grayscale", 4,
+			true, 4 * time.Second},
+		{"our last image left the queue", QueueStats{Workers: 2,
+			Running: 2, JobMs: 1000, Dequeued: 40}, false, marked,
+			"grayscale", 4, true, 2 * time.Second},
+		{"scheduler started again", QueueStats{Workers: 2, Running: 2,
+			JobMs: 1000, Dequeued: 3}, false, marked, "grayscale", 4,
+			true, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := test.stats
+			stats.Time = time.Now()
+			if test.stale {
+				stats.Time = time.Now().Add(-time.Minute)
+			}
+			queueStatsLock.Lock()
+			queueStats = stats
+			marks = test.marks
+			queueStatsLock.Unlock()
+
+			workload := Workload{Id: 0, Filter: test.filter}
+			eta, ok := estimate(workload, test.waiting)
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			got := time.Until(eta)
+			if got > test.expected || got < test.expected-time.Second/10 {
+				t.Errorf("eta in %v, want %v", got, test.expected)
+			}
+		})
+	}
+}
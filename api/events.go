@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/sub"
+)
+
+// Event is a change in the state of a job, published by the
+// controller (see controller/events.go)
+type Event struct {
+	// job-queued, job-started, job-finished, job-failed,
+	// job-timeout, job-duplicated
+	Type       string    `json:"type"`
+	JobId      uint64    `json:"job_id"`
+	WorkloadId uint64    `json:"workload_id"`
+	ImageId    uint64    `json:"image_id"`
+	Filter     string    `json:"filter"`
+	Worker     string    `json:"worker,omitempty"`
+	Time       time.Time `json:"time"`
+	WaitMs     int64     `json:"wait_ms,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	TimeoutMs  int64     `json:"timeout_ms,omitempty"` // time the worker had
+	Error      string    `json:"error,omitempty"`
+}
+
+var eventsUrl = "tcp://localhost:40904"
+
+// channels of the clients listening to each workload
+var listeners = make(map[uint64]map[chan Event]bool)
+var listenersLock sync.Mutex
+
+// the connection is kept open with a comment every now and then
+var keepAlive = 15 * time.Second
+
+// getEvents streams the events of the jobs of a workload with
+// Server-Sent Events, one per job state change:
+//
+//	event: job-finished
+//	data: {"type":"job-finished","job_id":3,...}
+//
+// the connection stays open until the client closes it
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	claims := principal(r) // see authorize
+	id := mux.Vars(r)["workload_id"]
+	fmt.Println("[INFO]: GET /workloads/" + id + "/events requested")
+	workloadId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	if !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "that id doesnt exists, "+
+			"please check again")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		returnError(w, r, 500, "server internal error, "+
+			"streaming not supported")
+		return
+	}
+
+	events := listen(workloadId)
+	defer stopListening(workloadId, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	var seq uint64 // id of the events of this stream, a job has many
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			seq++
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n",
+				seq, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getEvents(w, r) // get
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// PUBSUB receive the events of the controller and send them to the
+// clients listening to that workload
+func subscribeEvents() {
+	var sock mangos.Socket
+	var err error
+	var msg []byte
+
+	if sock, err = sub.NewSocket(); err != nil {
+		die("can't get new sub socket: %s", err.Error())
+	}
+	sock.SetOption(mangos.OptionDialAsynch, true)
+	if err = sock.Dial(eventsUrl); err != nil {
+		die("can't dial on sub socket: %s", err.Error())
+	}
+	if err = sock.SetOption(mangos.OptionSubscribe, []byte("")); err != nil {
+		die("can't subscribe: %s", err.Error())
+	}
+	for {
+		msg, err = sock.Recv()
+		if err != nil {
+			die("cannot receive from mangos Socket: %s", err.Error())
+		}
+		var event Event
+		if err = json.Unmarshal(msg, &event); err != nil {
+			fmt.Println("[ERROR] api couldnt parse event")
+			continue
+		}
+		dispatchEvent(event)
+	}
+}
+
+// dispatchEvent is everything the api does with an event, in order,
+// the image has to be unassigned before checking if the workload is
+// completed
+func dispatchEvent(event Event) {
+	recordJob(event)
+	jobEnded(event)
+	broadcast(event)
+	notifyWebhooks(event)
+}
+
+func listen(workloadId uint64) chan Event {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	events := make(chan Event, 64)
+	if listeners[workloadId] == nil {
+		listeners[workloadId] = make(map[chan Event]bool)
+	}
+	listeners[workloadId][events] = true
+	return events
+}
+
+func stopListening(workloadId uint64, events chan Event) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	delete(listeners[workloadId], events)
+	if len(listeners[workloadId]) == 0 {
+		delete(listeners, workloadId)
+	}
+}
+
+// slow clients lose events instead of blocking everyone
+func broadcast(event Event) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	for events := range listeners[event.WorkloadId] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
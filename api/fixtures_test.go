@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/pull"
+	_ "go.nanomsg.org/mangos/transport/all"
+)
+
+// resetState empties the fake db and everything the handlers keep
+// in memory, now and when the test ends, so the tests dont see
+// each other
+func resetState(t *testing.T) {
+	reset := func() {
+		accountsLock.Lock()
+		Accounts = nil
+		accountsIndex = make(map[string]int)
+		accountsLock.Unlock()
+		APIKeys, Workloads, Images, Animations = nil, nil, nil, nil
+		workloadsIds, imagesIds, animationsIds = 0, 0, 0
+
+		webhooksLock.Lock()
+		Webhooks, Deliveries = nil, nil
+		webhooksIds, deliveriesIds = 0, 0
+		webhooksLock.Unlock()
+		completedLock.Lock()
+		completed = make(map[uint64]bool)
+		completedLock.Unlock()
+
+		assignedLock.Lock()
+		assigned = make(map[uint64]string)
+		uploaded = make(map[jobResult]bool)
+		assignedLock.Unlock()
+
+		bucketsLock.Lock()
+		buckets = make(map[string]*bucket)
+		lastSweep = time.Time{}
+		bucketsLock.Unlock()
+
+		queueStatsLock.Lock()
+		queueStats = QueueStats{}
+		pushedSince = 0
+		marks = make(map[uint64]queueMark)
+		queueStatsLock.Unlock()
+		filterStatsLock.Lock()
+		filterStats = make(map[string]*throughput)
+		filterStatsLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// freshStats are queue stats the scheduler just sent (see
+// subscribeQueue)
+func freshStats(stats QueueStats) {
+	stats.Time = time.Now()
+	queueStatsLock.Lock()
+	queueStats = stats
+	pushedSince = 0
+	queueStatsLock.Unlock()
+}
+
+// setAccounts registers the accounts as if they had signed up
+func setAccounts(accounts ...Account) {
+	for _, account := range accounts {
+		addAccount(account)
+	}
+}
+
+// testController listens where the workloads are pushed, in the
+// place of the controller, to see what is sent
+func testController(t *testing.T) mangos.Socket {
+	controller, err := pull.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := workloadsUrl
+	workloadsUrl = "inproc://" + t.Name()
+	t.Cleanup(func() {
+		workloadsUrl = old
+		controller.Close()
+	})
+	if err := controller.Listen(workloadsUrl); err != nil {
+		t.Fatal(err)
+	}
+	controller.SetOption(mangos.OptionRecvDeadline, time.Second)
+	return controller
+}
+
+func testPng() []byte {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+	return img.Bytes()
+}
+
+// upload posts the file to /images as the user, fields has the rest
+// of the form
+func upload(data []byte, claims Claims, fields map[string]string) int {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("data", "test")
+	part.Write(data)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/images", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	postImages(w, withPrincipal(r, claims))
+	return w.Code
+}
@@ -0,0 +1,332 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type WorkloadPatch struct {
+	Filter       *string `json:"filter"`
+	WorkloadName *string `json:"workload_name"`
+	Priority     *string `json:"priority"`
+	Deadline     *string `json:"deadline"` // "" removes it
+}
+
+// patchWorkloads renames the workload or changes its filter,
+// priority or deadline, the new ones are only used for the images
+// uploaded after this, the ones already sent to the controller keep
+// the old
+func patchWorkloads(w http.ResponseWriter, r *http.Request) {
+	workloadId, ok := ownedWorkload(w, r)
+	if !ok {
+		return
+	}
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var patch WorkloadPatch
+	if err := json.Unmarshal(body, &patch); err != nil {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	if patch.Filter == nil && patch.WorkloadName == nil &&
+		patch.Priority == nil && patch.Deadline == nil {
+		returnError(w, r, 400, "bad request, send filter, "+
+			"workload_name, priority, deadline or some of them")
+		return
+	}
+	if (patch.Filter != nil && *patch.Filter == "") ||
+		(patch.WorkloadName != nil && *patch.WorkloadName == "") {
+		returnError(w, r, 400, "filter and workload_name cant be empty")
+		return
+	}
+	if patch.Priority != nil && !validPriority(*patch.Priority) {
+		returnError(w, r, 400, "the priority sent isnt valid, "+
+			"try with interactive, normal or batch")
+		return
+	}
+	var deadline *time.Time
+	if patch.Deadline != nil && *patch.Deadline != "" {
+		var msg string
+		if deadline, msg = parseDeadline(*patch.Deadline); deadline == nil {
+			returnError(w, r, 400, msg)
+			return
+		}
+	}
+	var cancelled bool
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		cancelled = workload.Status == "cancelled"
+		if cancelled && patch.Filter != nil {
+			return
+		}
+		if patch.Filter != nil {
+			workload.Filter = *patch.Filter
+		}
+		if patch.WorkloadName != nil {
+			workload.Name = *patch.WorkloadName
+		}
+		if patch.Priority != nil {
+			workload.Priority = *patch.Priority
+		}
+		if patch.Deadline != nil {
+			workload.Deadline = deadline
+		}
+	})
+	if cancelled && patch.Filter != nil {
+		returnError(w, r, 409, "this workload was cancelled, "+
+			"its filter cant change")
+		return
+	}
+	if err := notifyController(workload, "update"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+	json.NewEncoder(w).Encode(withProgress(workload))
+}
+
+// delWorkloads removes the workload with its images (original
+// and filtered) and animations, the scheduler drops the jobs of
+// the workload that are still waiting. The id is never reused
+func delWorkloads(w http.ResponseWriter, r *http.Request) {
+	workloadId, ok := ownedWorkload(w, r)
+	if !ok {
+		return
+	}
+
+	imagesLock.Lock()
+	var images []Image
+	for _, image := range Images {
+		if image.WorkloadId == workloadId {
+			unassign(image.Id)
+			continue
+		}
+		images = append(images, image)
+	}
+	Images = images
+	imagesLock.Unlock()
+
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		workload.Status = "deleted"
+		workload.Images = nil
+		workload.Animations = nil
+		workload.SharedWith = nil
+	})
+	if err := notifyController(workload, "delete"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+	returnMsg(w, "the workload "+strconv.FormatUint(workloadId, 10)+
+		" and its images have been deleted")
+}
+
+// postCancel stops the workload, the jobs that haven't been sent
+// to a worker are dropped and it doesnt take new images. What was
+// already filtered can still be downloaded
+func postCancel(w http.ResponseWriter, r *http.Request) {
+	workloadId, ok := ownedWorkload(w, r)
+	if !ok {
+		return
+	}
+	var status string
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		status = workload.Status
+		workload.Status = "cancelled"
+	})
+	if status == "cancelled" {
+		returnError(w, r, 409, "this workload was already cancelled")
+		return
+	}
+
+	for _, id := range workload.Images {
+		if _, exists := searchFiltered(id); !exists {
+			unassign(id)
+		}
+	}
+	if err := notifyController(workload, "cancel"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+	json.NewEncoder(w).Encode(workload)
+}
+
+// postPause stops sending the jobs of the workload to the workers,
+// the ones a worker already has will finish. New images can still
+// be uploaded, they wait with the rest until it's resumed
+func postPause(w http.ResponseWriter, r *http.Request) {
+	workloadId, ok := ownedWorkload(w, r)
+	if !ok {
+		return
+	}
+	var status string
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		status = workload.Status
+		if status == "completed" {
+			workload.Status = "paused"
+		}
+	})
+	if status != "completed" {
+		returnError(w, r, 409, "only running workloads can be paused, "+
+			"this one is "+status)
+		return
+	}
+
+	if err := notifyController(workload, "pause"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+	json.NewEncoder(w).Encode(withProgress(workload))
+}
+
+// postResume sends the jobs that were waiting to the workers
+func postResume(w http.ResponseWriter, r *http.Request) {
+	workloadId, ok := ownedWorkload(w, r)
+	if !ok {
+		return
+	}
+	var status string
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		status = workload.Status
+		if status == "paused" {
+			workload.Status = "completed"
+		}
+	})
+	if status != "paused" {
+		returnError(w, r, 409, "this workload isnt paused")
+		return
+	}
+
+	if err := notifyController(workload, "resume"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+	json.NewEncoder(w).Encode(withProgress(workload))
+}
+
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postPause(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postResume(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postCancel(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// ownedWorkload reads the workload id of the path, only the owner
+// (or an admin) can change a workload, the people it was shared
+// with get 403
+func ownedWorkload(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	claims := principal(r) // see authorize
+	id := mux.Vars(r)["workload_id"]
+	fmt.Println("[INFO]: " + r.Method + " " + r.URL.Path + " requested")
+	workloadId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return 0, false
+	}
+	if !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "that id doesnt exists, "+
+			"please check again")
+		return 0, false
+	}
+	if workload, _ := searchWorkload(workloadId); workload.Owner !=
+		claims.Subject && claims.Role != roleAdmin {
+		returnError(w, r, 403, "only the owner of the workload "+
+			"can change it")
+		return 0, false
+	}
+	return workloadId, true
+}
+
+// acceptsImages answers 409 if the workload was cancelled
+func acceptsImages(w http.ResponseWriter, r *http.Request,
+	workloadId uint64) bool {
+	if workload, _ := searchWorkload(workloadId); workload.Status ==
+		"cancelled" {
+		returnError(w, r, 409, "this workload was cancelled, "+
+			"it doesnt take new images")
+		return false
+	}
+	return true
+}
+
+// the workload is active until it's cancelled or deleted
+func isActive(workload Workload) bool {
+	return workload.Status != "cancelled" && workload.Status != "deleted"
+}
+
+// the scheduler gives more turns to interactive workloads than to
+// normal ones, and more to normal than to batch
+func validPriority(priority string) bool {
+	return priority == "interactive" || priority == "normal" ||
+		priority == "batch"
+}
+
+// the filters the workers know (see worker/main.go)
+func validFilter(filter string) bool {
+	return filter == "blur" || filter == "grayscale"
+}
+
+// backlog is how many images of the workload are waiting to be
+// filtered (or being filtered right now)
+func backlog(workload Workload) int {
+	count := 0
+	for _, id := range workload.Images {
+		if isAssigned(id) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// notifyController sends the workload to the controller with the
+// change that was made, update, cancel, delete, pause, resume or
+// drop (the images in Dropped were deleted)
+func notifyController(workload Workload, action string) error {
+	workload.Action = action
+	workload.Pending = nil
+	wrkStr, err := json.Marshal(workload)
+	if err != nil {
+		return err
+	}
+	pushMsg(workloadsUrl, string(wrkStr))
+	return nil
+}
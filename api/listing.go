@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ImageList struct {
+	Images []ImageResp `json:"images"`
+	Total  int         `json:"total"` // images that match the filters
+	Next   string      `json:"next,omitempty"`
+}
+
+// imageFilter holds the query params of GET /images
+type imageFilter struct {
+	WorkloadId    *uint64
+	Type          string
+	Owner         string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Cursor        *uint64 // id of the last image of the previous page
+	Limit         int
+}
+
+var defaultPageSize = 100
+var maxPageSize = 1000
+
+// listImages returns the images info, it can be filtered with
+// workload_id, type, owner, created_after and created_before
+// (RFC 3339), and paginated with limit and cursor. total is the
+// number of images that match, and next is the link to the next
+// page, it's empty in the last one. Users only get the images
+// of the workloads they can see
+func listImages(w http.ResponseWriter, r *http.Request, claims Claims) {
+	filter, err := parseImageFilter(r.URL.Query())
+	if err != nil {
+		returnError(w, r, 400, "bad request, "+err.Error())
+		return
+	}
+
+	var list ImageList
+	list.Images = []ImageResp{}
+	for _, image := range allImages() {
+		if !filter.match(image) || !canSeeImage(claims, image) {
+			continue
+		}
+		list.Total += 1
+		if filter.Cursor != nil && image.Id <= *filter.Cursor {
+			continue
+		}
+		if len(list.Images) == filter.Limit {
+			// there's at least one more, so there's a next page
+			if list.Next == "" {
+				list.Next = nextPage(r.URL, list.Images)
+			}
+			continue
+		}
+
+		var tmp ImageResp
+		tmp.WorkloadId = image.WorkloadId
+		tmp.Id = image.Id
+		tmp.Type = image.Type
+		tmp.Size = image.Size
+		tmp.Owner = image.Owner
+		tmp.CreatedAt = image.CreatedAt
+		tmp.SourceId = image.SourceId
+		tmp.Filter = image.Filter
+		tmp.Version = image.Version
+		list.Images = append(list.Images, tmp)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+/********************* Helper Functions ***************************/
+
+func parseImageFilter(query url.Values) (imageFilter, error) {
+	var filter imageFilter
+	filter.Limit = defaultPageSize
+
+	if id := query.Get("workload_id"); id != "" {
+		workloadId, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return filter, errors.New("workload_id must be a number")
+		}
+		filter.WorkloadId = &workloadId
+	}
+	filter.Type = query.Get("type")
+	if filter.Type != "" && filter.Type != "original" &&
+		filter.Type != "filtered" {
+		return filter, errors.New("type must be original or filtered")
+	}
+	filter.Owner = query.Get("owner")
+
+	if after := query.Get("created_after"); after != "" {
+		t, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return filter, errors.New("created_after must be RFC 3339, " +
+				"like 2021-06-01T10:00:00Z")
+		}
+		filter.CreatedAfter = t
+	}
+	if before := query.Get("created_before"); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return filter, errors.New("created_before must be RFC 3339, " +
+				"like 2021-06-01T10:00:00Z")
+		}
+		filter.CreatedBefore = t
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return filter, errors.New("cursor isnt valid, " +
+				"use the next link you got")
+		}
+		filter.Cursor = &id
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return filter, errors.New("limit must be between 1 and " +
+				strconv.Itoa(maxPageSize))
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+func (filter imageFilter) match(image Image) bool {
+	if filter.WorkloadId != nil && image.WorkloadId != *filter.WorkloadId {
+		return false
+	}
+	if filter.Type != "" && image.Type != filter.Type {
+		return false
+	}
+	if filter.Owner != "" && image.Owner != filter.Owner {
+		return false
+	}
+	if !filter.CreatedAfter.IsZero() &&
+		!image.CreatedAt.After(filter.CreatedAfter) {
+		return false
+	}
+	if !filter.CreatedBefore.IsZero() &&
+		!image.CreatedAt.Before(filter.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// same url with the cursor pointing to the last image in the page
+func nextPage(current *url.URL, page []ImageResp) string {
+	query := current.Query()
+	query.Set("cursor", strconv.FormatUint(page[len(page)-1].Id, 10))
+	next := url.URL{Path: current.Path, RawQuery: query.Encode()}
+	return next.String()
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// every error the api returns looks like this, request_id is also
+// in the X-Request-Id header and in the logs, so errors can be
+// found in them
+type ErrorResp struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id"`
+}
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	principalKey
+)
+
+// the middleware chain is:
+//
+//	withRequestId -> router -> authorize -> handler
+//
+// withRequestId wraps the router so even 404s get an id
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIdKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// returnError writes the error envelope with the status code
+func returnError(w http.ResponseWriter, r *http.Request, code int,
+	msg string) {
+	id := requestId(r)
+	if code >= 500 {
+		fmt.Println("[ERROR] request " + id + ": " + msg)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResp{
+		Code:      code,
+		Message:   msg,
+		RequestId: id,
+	})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	returnError(w, r, 404, "page not found")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	returnError(w, r, 405, "method not allowed")
+}
+
+/********************* Helper Functions ***************************/
+
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey).(string)
+	return id
+}
+
+// principal returns the claims of the token that authorize
+// validated, handlers that need a token always have one
+func principal(r *http.Request) Claims {
+	claims, _ := r.Context().Value(principalKey).(Claims)
+	return claims
+}
+
+func withPrincipal(r *http.Request, claims Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey,
+		claims))
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
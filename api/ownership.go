@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type ShareReq struct {
+	Username string `json:"user"`
+}
+
+// postShare lets the owner of a workload share it with other
+// user, they can see it, its images, and upload images to it.
+// Only the owner can share it with more people
+func postShare(w http.ResponseWriter, r *http.Request) {
+	shareWorkload(w, r, true)
+}
+
+// delShare stops sharing the workload with that user
+func delShare(w http.ResponseWriter, r *http.Request) {
+	shareWorkload(w, r, false)
+}
+
+func shareWorkload(w http.ResponseWriter, r *http.Request, share bool) {
+	claims := principal(r) // see authorize
+
+	// read path params
+	vars := mux.Vars(r)
+	id := vars["workload_id"]
+	fmt.Println("[INFO]: " + r.Method + " /workloads/" + id +
+		"/share requested")
+	workloadId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	if !workloadExists(claims, workloadId) {
+		returnError(w, r, 404, "that id doesnt exists, "+
+			"please check again")
+		return
+	}
+	if workload, _ := searchWorkload(workloadId); workload.Owner !=
+		claims.Subject {
+		returnError(w, r, 403, "only the owner of the workload can share it")
+		return
+	}
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var shareReq ShareReq
+	json.Unmarshal(body, &shareReq)
+	if shareReq.Username == "" {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	if _, exists := searchAccount(shareReq.Username); !exists {
+		returnError(w, r, 404, "the user "+shareReq.Username+" doesnt exists")
+		return
+	}
+
+	workload := changeWorkload(workloadId, func(workload *Workload) {
+		shared := removeString(workload.SharedWith, shareReq.Username)
+		if share && shareReq.Username != claims.Subject {
+			shared = append(shared, shareReq.Username)
+		}
+		workload.SharedWith = shared
+	})
+	json.NewEncoder(w).Encode(workload)
+}
+
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postShare(w, r) // post
+	case http.MethodDelete:
+		delShare(w, r) // delete
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// canSee tells if the user can see the workload, it has to be
+// the owner or someone it was shared with. Admins see all of
+// them, workers dont see workloads, only their images (see
+// canSeeImage)
+func canSee(claims Claims, workload Workload) bool {
+	if claims.Role == roleWorker || workload.Status == "deleted" {
+		return false
+	}
+	if claims.Role == roleAdmin || workload.Owner == claims.Subject {
+		return true
+	}
+	for _, user := range workload.SharedWith {
+		if user == claims.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// workloadExists is false for workloads that dont exist and for
+// the ones the user can't see, so nobody can guess which ids
+// belong to other people
+func workloadExists(claims Claims, id uint64) bool {
+	workload, exists := searchWorkload(id)
+	return exists && canSee(claims, workload)
+}
+
+// an image can be seen by whoever can see its workload, workers
+// can only see the images they have to filter
+func canSeeImage(claims Claims, image Image) bool {
+	if claims.Role == roleWorker {
+		return image.Type == "original" && isAssigned(image.Id)
+	}
+	return workloadExists(claims, image.WorkloadId)
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits of a user, everything is kept in memory so somebody has
+// to stop people from uploading their whole hard drive. The
+// defaults come from the env (see loadLimits) and an admin can
+// change them for a user with PUT /users/{user}/limits
+type Limits struct {
+	StorageBytes      int64   `json:"storage_bytes"`
+	Images            int     `json:"images"`
+	Workloads         int     `json:"active_workloads"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+type Usage struct {
+	User         string `json:"user"`
+	StorageBytes int64  `json:"storage_bytes"`
+	Images       int    `json:"images"`
+	Workloads    int    `json:"active_workloads"`
+	Limits       Limits `json:"limits"`
+}
+
+var defaultLimits = loadLimits()
+
+// token bucket of each user (or ip for the public endpoints), full
+// is when it will have burst tokens again if nobody takes any
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+var buckets = make(map[string]*bucket)
+var bucketsLock sync.Mutex
+
+// every ip that ever hit a public endpoint gets a bucket, so once a
+// minute takeToken throws away the ones that are already full, a
+// new bucket starts full anyway so nobody notices
+var lastSweep time.Time
+
+const sweepEvery = time.Minute
+
+// rateLimit goes right after authorize, every user has a bucket
+// that fills with requests_per_second tokens up to burst, each
+// request takes one. When it's empty we answer 429 and tell them
+// in Retry-After when there will be a token again. Workers are
+// not limited, they are part of the system
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := principal(r)
+		if claims.Role == roleWorker {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := claims.Subject
+		limits := limitsFor(claims.Subject)
+		if key == "" {
+			key = "ip:" + clientIp(r)
+			limits = defaultLimits
+		}
+		ok, wait := takeToken(key, limits)
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			returnError(w, r, 429, fmt.Sprintf("too many requests, "+
+				"try again in %d seconds", seconds))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getUsage shows how much of their limits the user is using
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /me/usage requested")
+	claims := principal(r) // see authorize
+	json.NewEncoder(w).Encode(usageOf(claims.Subject))
+}
+
+// putLimits changes the limits of a user, fields not sent keep
+// their current value
+func putLimits(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+	fmt.Println("[INFO]: PUT /users/" + username + "/limits requested")
+	account, exists := searchAccount(username)
+	if !exists || account.Role == roleWorker {
+		returnError(w, r, 404, "the account "+username+" doesnt exists")
+		return
+	}
+
+	limits := limitsFor(username)
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &limits); err != nil {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	if limits.StorageBytes < 0 || limits.Images < 0 ||
+		limits.Workloads < 0 || limits.RequestsPerSecond <= 0 ||
+		limits.Burst < 1 {
+		returnError(w, r, 400, "limits cant be negative, and "+
+			"requests_per_second and burst must be at least 1")
+		return
+	}
+	if !setLimits(username, limits) {
+		returnError(w, r, 404, "the account "+username+" doesnt exists")
+		return
+	}
+	json.NewEncoder(w).Encode(usageOf(username))
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getUsage(w, r) // get
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		putLimits(w, r) // put
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+func loadLimits() Limits {
+	limits := Limits{
+		StorageBytes:      1 << 30, // 1GB
+		Images:            10000,
+		Workloads:         20,
+		RequestsPerSecond: 10,
+		Burst:             20,
+	}
+	if value, err := strconv.ParseInt(os.Getenv("DPIP_QUOTA_STORAGE"),
+		10, 64); err == nil && value >= 0 {
+		limits.StorageBytes = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("DPIP_QUOTA_IMAGES")); err == nil &&
+		value >= 0 {
+		limits.Images = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("DPIP_QUOTA_WORKLOADS")); err == nil &&
+		value >= 0 {
+		limits.Workloads = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("DPIP_RATE_LIMIT"),
+		64); err == nil && value > 0 {
+		limits.RequestsPerSecond = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("DPIP_RATE_BURST")); err == nil &&
+		value > 0 {
+		limits.Burst = value
+	}
+	return limits
+}
+
+func limitsFor(username string) Limits {
+	account, exists := searchAccount(username)
+	if exists && account.Limits != nil {
+		return *account.Limits
+	}
+	return defaultLimits
+}
+
+// usageOf counts the images (original and filtered) and the
+// active workloads of the user
+func usageOf(username string) Usage {
+	var usage Usage
+	usage.User = username
+	usage.Limits = limitsFor(username)
+	for _, image := range allImages() {
+		if image.Owner == username {
+			usage.Images += 1
+			usage.StorageBytes += int64(image.Size)
+		}
+	}
+	workloadsLock.Lock()
+	defer workloadsLock.Unlock()
+	for _, workload := range Workloads {
+		if workload.Owner == username && isActive(workload) {
+			usage.Workloads += 1
+		}
+	}
+	return usage
+}
+
+// checkQuota is called before adding images, if they dont fit in
+// the limits of the user it answers 403 and returns false
+func checkQuota(w http.ResponseWriter, r *http.Request, images int,
+	bytes int64) bool {
+	usage := usageOf(principal(r).Subject)
+	if usage.Images+images > usage.Limits.Images {
+		returnError(w, r, 403, fmt.Sprintf("image quota exceeded, "+
+			"you have %d of %d images", usage.Images, usage.Limits.Images))
+		return false
+	}
+	if usage.StorageBytes+bytes > usage.Limits.StorageBytes {
+		returnError(w, r, 403, fmt.Sprintf("storage quota exceeded, "+
+			"you are using %d of %d bytes", usage.StorageBytes,
+			usage.Limits.StorageBytes))
+		return false
+	}
+	return true
+}
+
+func checkWorkloadQuota(w http.ResponseWriter, r *http.Request) bool {
+	usage := usageOf(principal(r).Subject)
+	if usage.Workloads >= usage.Limits.Workloads {
+		returnError(w, r, 403, fmt.Sprintf("workload quota exceeded, "+
+			"you have %d of %d workloads", usage.Workloads,
+			usage.Limits.Workloads))
+		return false
+	}
+	return true
+}
+
+// takeToken refills the bucket for the time since the last
+// request and takes a token, if there's none it says how long to
+// wait for the next one
+func takeToken(key string, limits Limits) (bool, time.Duration) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastSweep) >= sweepEvery {
+		sweepBuckets(now)
+		lastSweep = now
+	}
+	b, exists := buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(limits.Burst), last: now}
+		buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limits.RequestsPerSecond
+	if b.tokens > float64(limits.Burst) {
+		b.tokens = float64(limits.Burst)
+	}
+	b.last = now
+	ok := b.tokens >= 1
+	if ok {
+		b.tokens -= 1
+	}
+	b.full = now.Add(refillTime(float64(limits.Burst)-b.tokens, limits))
+	if !ok {
+		return false, refillTime(1-b.tokens, limits)
+	}
+	return true, 0
+}
+
+// sweepBuckets deletes the buckets that refilled to burst, needs
+// bucketsLock
+func sweepBuckets(now time.Time) {
+	for key, b := range buckets {
+		if !now.Before(b.full) {
+			delete(buckets, key)
+		}
+	}
+}
+
+func refillTime(tokens float64, limits Limits) time.Duration {
+	return time.Duration(tokens / limits.RequestsPerSecond *
+		float64(time.Second))
+}
+
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
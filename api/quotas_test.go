@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckQuota(t *testing.T) {
+	resetState(t)
+	setAccounts(Account{Username: "ana", Role: roleUser, Limits: &Limits{
+		StorageBytes: 1000, Images: 3, Workloads: 1,
+		RequestsPerSecond: 1, Burst: 1}},
+		Account{Username: "root", Role: roleAdmin})
+	Images = []Image{
+		{Id: 0, Owner: "ana", Size: 300},
+		{Id: 1, Owner: "ana", Size: 300},
+		{Id: 2, Owner: "root", Size: 5000},
+	}
+	Workloads = []Workload{
+		{Id: 0, Owner: "ana", Status: "running"},
+		{Id: 1, Owner: "root", Status: "cancelled"},
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		images int
+		bytes  int64
+		ok     bool
+	}{
+		{"fits", "ana", 1, 100, true},
+		{"fills the storage", "ana", 1, 400, true},
+		{"too many images", "ana", 2, 10, false},
+		{"too many bytes", "ana", 1, 401, false},
+		{"default limits", "root", 100, 1 << 20, true},
+		{"over the default images", "root", 10000, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/images", nil)
+			r = withPrincipal(r, Claims{Subject: test.user})
+			w := httptest.NewRecorder()
+			ok := checkQuota(w, r, test.images, test.bytes)
+			if ok != test.ok {
+				t.Fatalf("got %v, want %v", ok, test.ok)
+			}
+			if !ok && w.Code != 403 {
+				t.Errorf("got %d, want 403", w.Code)
+			}
+		})
+	}
+
+	tests = []struct {
+		name   string
+		user   string
+		images int
+		bytes  int64
+		ok     bool
+	}{
+		{"one active workload of one", "ana", 0, 0, false},
+		{"cancelled ones dont count", "root", 0, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/workloads", nil)
+			r = withPrincipal(r, Claims{Subject: test.user})
+			w := httptest.NewRecorder()
+			if ok := checkWorkloadQuota(w, r); ok != test.ok {
+				t.Errorf("got %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	limits := Limits{RequestsPerSecond: 2, Burst: 3}
+	key := "test-take-token"
+	t.Cleanup(func() {
+		bucketsLock.Lock()
+		delete(buckets, key)
+		bucketsLock.Unlock()
+	})
+
+	// each step goes back in time the bucket by ago, as if that
+	// time had passed, then takes a token
+	tests := []struct {
+		ago  time.Duration
+		ok   bool
+		wait time.Duration // at most
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{250 * time.Millisecond, true, 0},
+		{time.Hour, true, 0}, // full again, but not over burst
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+	}
+	for i, test := range tests {
+		bucketsLock.Lock()
+		if b, exists := buckets[key]; exists {
+			b.last = b.last.Add(-test.ago)
+		}
+		bucketsLock.Unlock()
+		ok, wait := takeToken(key, limits)
+		if ok != test.ok {
+			t.Fatalf("step %d: got %v, want %v", i, ok, test.ok)
+		}
+		if wait > test.wait || (!ok && wait <= 0) {
+			t.Errorf("step %d: wait %v, want (0, %v]", i, wait, test.wait)
+		}
+	}
+}
+
+func TestSweepBuckets(t *testing.T) {
+	resetState(t)
+	limits := Limits{RequestsPerSecond: 1, Burst: 2}
+	takeToken("idle", limits)
+	takeToken("busy", limits)
+	takeToken("busy", limits)
+
+	// a bit more than a second later idle is full again, busy still
+	// needs another second
+	bucketsLock.Lock()
+	for _, b := range buckets {
+		b.last = b.last.Add(-1100 * time.Millisecond)
+		b.full = b.full.Add(-1100 * time.Millisecond)
+	}
+	lastSweep = time.Time{}
+	bucketsLock.Unlock()
+
+	takeToken("other", limits)
+	bucketsLock.Lock()
+	_, idle := buckets["idle"]
+	_, busy := buckets["busy"]
+	bucketsLock.Unlock()
+	if idle {
+		t.Errorf("the full bucket wasnt evicted")
+	}
+	if !busy {
+		t.Errorf("the bucket still refilling was evicted")
+	}
+
+	// the sweep waits a minute, so this one stays even when full
+	bucketsLock.Lock()
+	buckets["busy"].full = time.Now().Add(-time.Hour)
+	bucketsLock.Unlock()
+	takeToken("other", limits)
+	bucketsLock.Lock()
+	_, busy = buckets["busy"]
+	bucketsLock.Unlock()
+	if !busy {
+		t.Errorf("swept again before a minute")
+	}
+
+	// an evicted key starts full again
+	for i := 0; i < limits.Burst; i++ {
+		if ok, _ := takeToken("idle", limits); !ok {
+			t.Fatalf("token %d: the new bucket wasnt full", i)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	resetState(t)
+	setAccounts(Account{Username: "ana", Role: roleUser, Limits: &Limits{
+		StorageBytes: 1000, Images: 3, Workloads: 1,
+		RequestsPerSecond: 1, Burst: 2}},
+		Account{Username: "pedro", Role: roleWorker})
+	handler := rateLimit(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+	tests := []struct {
+		name   string
+		claims Claims
+		status []int // of requests in a row
+	}{
+		{"user burst", Claims{Subject: "ana", Role: roleUser},
+			[]int{200, 200, 429, 429}},
+		{"worker", Claims{Subject: "pedro", Role: roleWorker},
+			[]int{200, 200, 200, 200, 200, 200}},
+		{"public by ip", Claims{},
+			[]int{200, 200, 200}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, status := range test.status {
+				r := httptest.NewRequest("GET", "/workloads", nil)
+				r = withPrincipal(r, test.claims)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != status {
+					t.Fatalf("request %d: got %d, want %d", i, w.Code,
+						status)
+				}
+				if status == 429 && w.Header().Get("Retry-After") != "1" {
+					t.Errorf("Retry-After = %q, want 1",
+						w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
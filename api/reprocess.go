@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type ReprocessReq struct {
+	Filter string `json:"filter"` // empty uses the workload's
+}
+
+type DeleteMsg struct {
+	Message string   `json:"message"`
+	Deleted []uint64 `json:"deleted_images"`
+}
+
+type ReprocessMsg struct {
+	Message    string     `json:"message"`
+	WorkloadId uint64     `json:"workload_id"`
+	ImageId    uint64     `json:"image_id"`
+	Filter     string     `json:"filter"`
+	Version    int        `json:"version"` // the one that will be created
+	Queue      *QueueInfo `json:"queue,omitempty"`
+}
+
+// delImages removes an image, if it's an original its filtered
+// versions go with it. The jobs still waiting for them are dropped
+// and an animation that loses a frame is marked broken. The image
+// id is never reused
+func delImages(w http.ResponseWriter, r *http.Request) {
+	image, ok := changeableImage(w, r)
+	if !ok {
+		return
+	}
+
+	removed := []uint64{image.Id}
+	imagesLock.Lock()
+	var images []Image
+	for _, tmp := range Images {
+		if tmp.Id == image.Id {
+			continue
+		}
+		if image.Type == "original" && tmp.Type == "filtered" &&
+			tmp.SourceId == image.Id {
+			removed = append(removed, tmp.Id)
+			continue
+		}
+		images = append(images, tmp)
+	}
+	Images = images
+	breakAnimations(image)
+	imagesLock.Unlock()
+	unassign(image.Id)
+
+	dropped := changeWorkload(image.WorkloadId, func(workload *Workload) {
+		workload.Images = removeId(workload.Images, image.Id)
+	})
+
+	// the jobs still queued for them would fail, drop them
+	dropped.Dropped = removed
+	if err := notifyController(dropped, "drop"); err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(DeleteMsg{
+		Message: fmt.Sprintf("%d images have been deleted", len(removed)),
+		Deleted: removed,
+	})
+}
+
+// postReprocess filters an original image again, with the filter
+// of the workload or the one sent in the body. The filtered images
+// it already had are kept as older versions, they show up in the
+// listing with their source_id and version
+func postReprocess(w http.ResponseWriter, r *http.Request) {
+	image, ok := changeableImage(w, r)
+	if !ok {
+		return
+	}
+	if image.Type != "original" {
+		returnError(w, r, 400, "only original images can be "+
+			"reprocessed, use its source_id")
+		return
+	}
+	if !acceptsImages(w, r, image.WorkloadId) {
+		return
+	}
+
+	// handle body request, it's optional
+	body, _ := ioutil.ReadAll(r.Body)
+	var reprocessReq ReprocessReq
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &reprocessReq); err != nil {
+			returnError(w, r, 400, "bad request, "+
+				"json sent misspelled or missing field")
+			return
+		}
+	}
+	if reprocessReq.Filter != "" && !validFilter(reprocessReq.Filter) {
+		returnError(w, r, 400, "the filter sent isnt valid, "+
+			"try with blur or grayscale")
+		return
+	}
+	if !checkQuota(w, r, 1, int64(image.Size)) || !checkBacklog(w, r) {
+		return
+	}
+
+	workload, _ := searchWorkload(image.WorkloadId)
+	filter := reprocessReq.Filter
+	if filter == "" {
+		filter = workload.Filter
+	}
+	pending := []PendingImage{{Id: image.Id, Filter: reprocessReq.Filter}}
+	imagesLock.Lock()
+	queue := queueInfo()
+	err := pushPending(workload, pending)
+	imagesLock.Unlock()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt marshal json")
+		return
+	}
+
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(ReprocessMsg{
+		Message:    "the image will be filtered again",
+		WorkloadId: image.WorkloadId,
+		ImageId:    image.Id,
+		Filter:     filter,
+		Version:    len(filteredVersions(image.Id)) + 1,
+		Queue:      queue,
+	})
+}
+
+func handleReprocess(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postReprocess(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// changeableImage reads the image id of the path, the image can be
+// changed by who uploaded it, the owner of the workload or an admin
+func changeableImage(w http.ResponseWriter, r *http.Request) (Image, bool) {
+	claims := principal(r) // see authorize
+	id := mux.Vars(r)["image_id"]
+	fmt.Println("[INFO]: " + r.Method + " " + r.URL.Path + " requested")
+	intId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return Image{}, false
+	}
+	_, image, exists := searchImage(intId)
+	if !exists || !canSeeImage(claims, image) {
+		returnError(w, r, 404, "the image id doesnt exists")
+		return image, false
+	}
+	workload, _ := searchWorkload(image.WorkloadId)
+	if image.Owner != claims.Subject && claims.Role != roleAdmin &&
+		workload.Owner != claims.Subject {
+		returnError(w, r, 403, "only who uploaded the image or the "+
+			"owner of the workload can change it")
+		return image, false
+	}
+	return image, true
+}
+
+// filtered versions of an original, oldest first
+func filteredVersions(sourceId uint64) []Image {
+	var versions []Image
+	for _, image := range allImages() {
+		if image.Type == "filtered" && image.SourceId == sourceId {
+			versions = append(versions, image)
+		}
+	}
+	return versions
+}
+
+func removeId(list []uint64, id uint64) []uint64 {
+	var result []uint64
+	for _, item := range list {
+		if item != id {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReprocessFilter(t *testing.T) {
+	resetState(t)
+	controller := testController(t)
+	setAccounts(Account{Username: "ana", Role: roleUser})
+	Workloads = []Workload{{Id: 0, Owner: "ana", Status: "completed",
+		Filter: "blur", Images: []uint64{0}}}
+	workloadsIds = 1
+	Images = []Image{{Id: 0, WorkloadId: 0, Type: "original",
+		Owner: "ana", Data: testPng()}}
+	imagesIds = 1
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		filter string // the image is sent with
+	}{
+		{"workload filter", "", 202, "blur"},
+		{"blur", `{"filter": "blur"}`, 202, "blur"},
+		{"grayscale", `{"filter": "grayscale"}`, 202, "grayscale"},
+		{"unknown filter", `{"filter": "sepia"}`, 400, ""},
+		{"bad json", `{"filter":`, 400, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unassign(0)
+			r := httptest.NewRequest("POST", "/images/0/reprocess",
+				strings.NewReader(test.body))
+			r = mux.SetURLVars(withPrincipal(r, Claims{Subject: "ana",
+				Role: roleUser}), map[string]string{"image_id": "0"})
+			w := httptest.NewRecorder()
+			postReprocess(w, r)
+			if w.Code != test.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.status,
+					w.Body.String())
+			}
+			if test.status != 202 {
+				if isAssigned(0) {
+					t.Error("the image was sent anyway")
+				}
+				return
+			}
+			if _, err := controller.Recv(); err != nil {
+				t.Fatalf("nothing was pushed: %v", err)
+			}
+			if got := assignedFilter(0); got != test.filter {
+				t.Errorf("sent with %q, want %q", got, test.filter)
+			}
+		})
+	}
+}
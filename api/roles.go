@@ -0,0 +1,279 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// roles of the accounts:
+//
+//	user   creates workloads, uploads originals and downloads results
+//	worker only fetches the images it was assigned and uploads them
+//	       filtered, the controller registers them (see postWorkers)
+//	admin  same as user but can see everything and manage accounts
+var (
+	roleUser   = "user"
+	roleWorker = "worker"
+	roleAdmin  = "admin"
+)
+
+// endpoints that dont need a token
+var public = map[string]bool{
+	"GET /":         true,
+	"POST /users":   true,
+	"POST /login":   true,
+	"POST /refresh": true,
+	"POST /workers": true, // needs the cluster key instead
+}
+
+// who can call each endpoint and the scope an api key needs to
+// call it (see apikeys.go), endpoints without scope need a login
+// token. Anything not here (and not public) doesnt exist. POST
+// /images is split by the type of the image
+type permission struct {
+	roles []string
+	scope string
+}
+
+var (
+	everyone = []string{roleUser, roleWorker, roleAdmin}
+	people   = []string{roleUser, roleAdmin}
+	admins   = []string{roleAdmin}
+	workers  = []string{roleWorker}
+)
+
+var permissions = map[string]permission{
+	"GET /status":                           {people, "workloads:read"},
+	"DELETE /logout":                        {everyone, ""},
+	"GET /users":                            {admins, ""},
+	"DELETE /users/{user}":                  {admins, ""},
+	"PUT /users/{user}/limits":              {admins, ""},
+	"GET /me/usage":                         {people, "workloads:read"},
+	"GET /workers":                          {admins, ""},
+	"DELETE /workers/{user}":                {admins, ""},
+	"GET /keys":                             {people, ""},
+	"POST /keys":                            {people, ""},
+	"DELETE /keys/{key_id}":                 {people, ""},
+	"GET /webhooks":                         {people, "workloads:read"},
+	"POST /webhooks":                        {people, "workloads:write"},
+	"DELETE /webhooks/{webhook_id}":         {people, "workloads:write"},
+	"GET /webhooks/{webhook_id}/deliveries": {people, "workloads:read"},
+	"GET /workloads":                        {people, "workloads:read"},
+	"POST /workloads":                       {people, "workloads:write"},
+	"GET /workloads/{workload_id}":          {people, "workloads:read"},
+	"PATCH /workloads/{workload_id}":        {people, "workloads:write"},
+	"DELETE /workloads/{workload_id}":       {people, "workloads:write"},
+	"POST /workloads/{workload_id}/cancel":  {people, "workloads:write"},
+	"POST /workloads/{workload_id}/pause":   {people, "workloads:write"},
+	"POST /workloads/{workload_id}/resume":  {people, "workloads:write"},
+	"GET /workloads/{workload_id}/sequence": {people, "workloads:read"},
+	"GET /workloads/{workload_id}/events":   {people, "workloads:read"},
+	"GET /workloads/{workload_id}/archive":  {people, "workloads:read"},
+	"POST /workloads/{workload_id}/archive": {people, "images:write"},
+	"POST /workloads/{workload_id}/share":   {people, "workloads:write"},
+	"DELETE /workloads/{workload_id}/share": {people, "workloads:write"},
+	"POST /images original":                 {people, "images:write"},
+	"POST /images filtered":                 {workers, ""},
+	"GET /images":                           {people, "images:read"},
+	"GET /images/{image_id}":                {everyone, "images:read"},
+	"DELETE /images/{image_id}":             {people, "images:write"},
+	"POST /images/{image_id}/reprocess":     {people, "images:write"},
+	"GET /animations/{animation_id}":        {people, "workloads:read"},
+}
+
+// images sent to the controller that haven't been filtered yet,
+// and the filter they were sent with, those are the only ones a
+// worker can fetch or upload results for
+var assigned = make(map[uint64]string)
+var assignedLock sync.Mutex
+
+// jobs that already uploaded their image, the scheduler can run a
+// job twice (see scheduler/stragglers.go). They are forgotten when
+// the job ends (see jobEnded)
+type jobResult struct {
+	jobId    uint64
+	sourceId uint64
+}
+
+var uploaded = make(map[jobResult]bool)
+
+// authorize is the only place where tokens and roles are checked,
+// every request goes through it before reaching the handlers. It
+// validates the access token, checks that the account still
+// exists with the same role, and that the role can call the
+// endpoint. Then it leaves the claims in the request context
+// for the handlers (see principal)
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := r.Method + " " + routeTemplate(r)
+		if public[endpoint] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the uploads need the type from the form, it's read after
+		// the token so nobody can make us parse a body without one
+		uploads := endpoint == "POST /images"
+		if _, exists := permissions[endpoint]; !exists && !uploads {
+			methodNotAllowed(w, r)
+			return
+		}
+
+		var claims Claims
+		var err error
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			claims, err = checkAPIKey(key)
+		} else if token, ok := bearerToken(r); ok {
+			claims, err = checkToken(token, "access")
+		} else {
+			returnError(w, r, 401, "you must send a Bearer token "+
+				"in the Authorization header or an X-API-Key")
+			return
+		}
+		if err != nil {
+			returnError(w, r, 401, err.Error())
+			return
+		}
+		account, exists := searchAccount(claims.Subject)
+		if !exists || account.Role != claims.Role {
+			returnError(w, r, 401, "your account changed or was removed, "+
+				"please login again")
+			return
+		}
+		if uploads {
+			endpoint += " " + r.FormValue("type")
+		}
+		perm, exists := permissions[endpoint]
+		if !exists {
+			returnError(w, r, 400, "the type sent isnt valid, "+
+				"try with original or filtered")
+			return
+		}
+		if !hasRole(perm.roles, claims.Role) {
+			fmt.Println("[INFO]: " + claims.Subject + " (" + claims.Role +
+				") not allowed to " + endpoint)
+			returnError(w, r, 403, "a "+claims.Role+" cant do that")
+			return
+		}
+		if claims.Type == "apikey" && !hasScope(claims, perm.scope) {
+			returnError(w, r, 403, "this api key cant do that, "+
+				"it needs the "+perm.scope+" scope")
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, claims))
+	})
+}
+
+/********************* Helper Functions ***************************/
+
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return r.URL.Path
+	}
+	return template
+}
+
+// bearerToken reads "Authorization: Bearer <token>"
+func bearerToken(r *http.Request) (string, bool) {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 || fields[0] != "Bearer" {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// api keys without scopes can do everything their owner can,
+// except what needs a login token (empty scope)
+func hasScope(claims Claims, scope string) bool {
+	if scope == "" {
+		return false
+	}
+	if len(claims.Scopes) == 0 {
+		return true
+	}
+	for _, tmp := range claims.Scopes {
+		if tmp == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, tmp := range roles {
+		if tmp == role {
+			return true
+		}
+	}
+	return false
+}
+
+func assign(id uint64, filter string) {
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	assigned[id] = filter
+}
+
+func unassign(id uint64) {
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	delete(assigned, id)
+}
+
+func isAssigned(id uint64) bool {
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	_, exists := assigned[id]
+	return exists
+}
+
+func assignedFilter(id uint64) string {
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	return assigned[id]
+}
+
+// claimJob is false if the job already uploaded the filtered image
+// of that original
+func claimJob(jobId uint64, sourceId uint64) bool {
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	result := jobResult{jobId, sourceId}
+	if uploaded[result] {
+		return false
+	}
+	uploaded[result] = true
+	return true
+}
+
+// jobEnded forgets the upload of the job once the scheduler is done
+// with it. If the other attempt still uploads something late, the
+// first upload already unassigned the original so it's rejected.
+// A job that failed or timed out is not tried again, its image is
+// unassigned too or the workload would never be completed (see
+// backlog), unless it was sent again with another filter since
+func jobEnded(event Event) {
+	switch event.Type {
+	case "job-finished", "job-failed", "job-timeout":
+	default:
+		return
+	}
+	assignedLock.Lock()
+	defer assignedLock.Unlock()
+	delete(uploaded, jobResult{event.JobId, event.ImageId})
+	if filter, exists := assigned[event.ImageId]; exists &&
+		filter == event.Filter {
+		delete(assigned, event.ImageId)
+	}
+}
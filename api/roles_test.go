@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// a router with the routes we check, the handlers just answer 200 so
+// anything else comes from authorize
+func testRouter() http.Handler {
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}
+	for _, path := range []string{"/login", "/logout", "/users",
+		"/workloads", "/workloads/{workload_id}", "/images"} {
+		router.HandleFunc(path, ok)
+	}
+	router.Use(authorize)
+	return router
+}
+
+func testAccounts(t *testing.T) {
+	resetState(t)
+	setAccounts(Account{Username: "ana", Role: roleUser},
+		Account{Username: "pedro", Role: roleWorker},
+		Account{Username: "root", Role: roleAdmin})
+	APIKeys = []APIKey{
+		{Id: "k0", Owner: "ana", Hash: hashKey("read-key"),
+			Scopes: []string{"workloads:read"}},
+		{Id: "k1", Owner: "ana", Hash: hashKey("any-key")},
+	}
+}
+
+func testToken(t *testing.T, username string, role string,
+	tokenType string) string {
+	token, err := signToken(username, role, tokenType, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthorize(t *testing.T) {
+	testAccounts(t)
+	router := testRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string // bearer
+		key    string // X-API-Key
+		form   string
+		status int
+	}{
+		{"public", "POST", "/login", "", "", "", 200},
+		{"no token", "GET", "/workloads", "", "", "", 401},
+		{"bad token", "GET", "/workloads", "abc.def.ghi", "", "", 401},
+		{"user", "GET", "/workloads/3",
+			testToken(t, "ana", roleUser, "access"), "", "", 200},
+		{"refresh as access", "GET", "/workloads",
+			testToken(t, "ana", roleUser, "refresh"), "", "", 401},
+		{"account removed", "GET", "/workloads",
+			testToken(t, "gone", roleUser, "access"), "", "", 401},
+		{"role changed", "GET", "/users",
+			testToken(t, "ana", roleAdmin, "access"), "", "", 401},
+		{"user on admin endpoint", "GET", "/users",
+			testToken(t, "ana", roleUser, "access"), "", "", 403},
+		{"admin", "GET", "/users",
+			testToken(t, "root", roleAdmin, "access"), "", "", 200},
+		{"worker on workloads", "GET", "/workloads",
+			testToken(t, "pedro", roleWorker, "access"), "", "", 403},
+		{"user uploads original", "POST", "/images",
+			testToken(t, "ana", roleUser, "access"), "",
+			"type=original", 200},
+		{"user uploads filtered", "POST", "/images",
+			testToken(t, "ana", roleUser, "access"), "",
+			"type=filtered", 403},
+		{"worker uploads filtered", "POST", "/images",
+			testToken(t, "pedro", roleWorker, "access"), "",
+			"type=filtered", 200},
+		{"bad image type", "POST", "/images",
+			testToken(t, "ana", roleUser, "access"), "",
+			"type=other", 400},
+		{"not in permissions", "PUT", "/workloads",
+			testToken(t, "ana", roleUser, "access"), "", "", 405},
+		{"key with scope", "GET", "/workloads", "", "read-key", "", 200},
+		{"key without the scope", "POST", "/workloads", "", "read-key",
+			"", 403},
+		{"key without scopes", "POST", "/workloads", "", "any-key", "",
+			200},
+		{"key on login only endpoint", "DELETE", "/logout", "", "any-key",
+			"", 403},
+		{"unknown key", "GET", "/workloads", "", "nope", "", 401},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path,
+				strings.NewReader(test.form))
+			if test.form != "" {
+				r.Header.Set("Content-Type",
+					"application/x-www-form-urlencoded")
+			}
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.key != "" {
+				r.Header.Set("X-API-Key", test.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("got %d, want %d: %s", w.Code, test.status,
+					w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{nil, "workloads:read", true},
+		{nil, "", false},
+		{[]string{"workloads:read"}, "workloads:read", true},
+		{[]string{"workloads:read"}, "workloads:write", false},
+		{[]string{"images:read", "images:write"}, "images:write", true},
+	}
+	for _, test := range tests {
+		got := hasScope(Claims{Scopes: test.scopes}, test.scope)
+		if got != test.want {
+			t.Errorf("hasScope(%v, %q) = %v, want %v", test.scopes,
+				test.scope, got, test.want)
+		}
+	}
+}
+
+// reads tells if the handler read the body
+type reads struct {
+	read bool
+}
+
+func (body *reads) Read(p []byte) (int, error) {
+	body.read = true
+	return 0, io.EOF
+}
+
+func TestAuthorizeBeforeForm(t *testing.T) {
+	testAccounts(t)
+	router := testRouter()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		read   bool
+	}{
+		{"no token", "", 401, false},
+		{"bad token", "abc.def.ghi", 401, false},
+		{"user", testToken(t, "ana", roleUser, "access"), 400, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := &reads{}
+			r := httptest.NewRequest("POST", "/images", body)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("got %d, want %d", w.Code, test.status)
+			}
+			if body.read != test.read {
+				t.Errorf("body read = %v, want %v", body.read, test.read)
+			}
+		})
+	}
+}
+
+func TestAccountsIndex(t *testing.T) {
+	testAccounts(t)
+	if addAccount(Account{Username: "ana", Role: roleAdmin}) {
+		t.Fatal("ana was added twice")
+	}
+	if removeAccount("pedro", false) {
+		t.Fatal("a worker was removed as a user")
+	}
+	if !removeAccount("pedro", true) {
+		t.Fatal("pedro wasnt removed")
+	}
+	setLimits("root", Limits{Images: 7})
+
+	tests := []struct {
+		username string
+		exists   bool
+		role     string
+	}{
+		{"ana", true, roleUser},
+		{"pedro", false, ""},
+		{"root", true, roleAdmin},
+		{"nobody", false, ""},
+	}
+	for _, test := range tests {
+		account, exists := searchAccount(test.username)
+		if exists != test.exists || account.Role != test.role {
+			t.Errorf("%s: got %v %q, want %v %q", test.username, exists,
+				account.Role, test.exists, test.role)
+		}
+	}
+	if account, _ := searchAccount("root"); account.Limits == nil ||
+		account.Limits.Images != 7 {
+		t.Errorf("root limits = %+v", account.Limits)
+	}
+}
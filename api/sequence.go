@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// SequenceProgress is shown in GET /workloads/{id} for the
+// workloads created with "mode": "sequence"
+type SequenceProgress struct {
+	Frames   int     `json:"frames"`
+	Filtered int     `json:"filtered_frames"`
+	Progress float64 `json:"progress"` // 0 to 100
+}
+
+// getSequence returns a zip with the filtered frames of a sequence
+// workload, named after their frame index so they keep their order
+// (000000.png, 000001.png, ...). If some frame hasn't been filtered
+// yet it returns 409 with the progress.
+func getSequence(w http.ResponseWriter, r *http.Request) {
+	claims := principal(r) // see authorize
+
+	// read path params
+	vars := mux.Vars(r)
+	id := vars["workload_id"]
+	fmt.Println("[INFO]: GET /workloads/" + id + "/sequence requested")
+	intId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return
+	}
+	if !workloadExists(claims, intId) {
+		returnError(w, r, 404, "that id doesnt exists, "+
+			"please check again")
+		return
+	}
+	workload, _ := searchWorkload(intId)
+	if workload.Mode != "sequence" {
+		returnError(w, r, 400, "this workload is not a sequence, "+
+			"create it with \"mode\": \"sequence\"")
+		return
+	}
+
+	progress := sequenceProgress(workload)
+	if progress.Frames == 0 || progress.Filtered < progress.Frames {
+		returnError(w, r, 409, fmt.Sprintf("sequence still being filtered, "+
+			"%d of %d frames are done", progress.Filtered,
+			progress.Frames))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"workload-%d.zip\"", intId))
+	w.WriteHeader(200)
+
+	archive := zip.NewWriter(w)
+	for _, original := range sequenceFrames(workload) {
+		filtered, _ := searchFiltered(original.Id)
+		entry, err := archive.Create(fmt.Sprintf("%06d.png",
+			original.Frame))
+		if err != nil {
+			fmt.Println("[ERROR] couldnt write sequence archive: " +
+				err.Error())
+			return
+		}
+		entry.Write(filtered.Data)
+	}
+	archive.Close()
+}
+
+func handleSequence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getSequence(w, r) // get
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+// Search the original image uploaded as a given frame of a workload
+func searchFrame(workloadId uint64, frame int) (Image, bool) {
+	for _, image := range allImages() {
+		if image.WorkloadId == workloadId && image.Type == "original" &&
+			image.Frame == frame {
+			return image, true
+		}
+	}
+	var tmp Image
+	return tmp, false
+}
+
+// original images of a sequence workload sorted by frame index
+func sequenceFrames(workload Workload) []Image {
+	var frames []Image
+	for _, id := range workload.Images {
+		_, image, exists := searchImage(id)
+		if !exists {
+			continue
+		}
+		frames = append(frames, image)
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Frame < frames[j].Frame
+	})
+	return frames
+}
+
+func sequenceProgress(workload Workload) SequenceProgress {
+	var progress SequenceProgress
+	for _, frame := range sequenceFrames(workload) {
+		progress.Frames += 1
+		if _, exists := searchFiltered(frame.Id); exists {
+			progress.Filtered += 1
+		}
+	}
+	if progress.Frames > 0 {
+		progress.Progress = 100 * float64(progress.Filtered) /
+			float64(progress.Frames)
+	}
+	return progress
+}
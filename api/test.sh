@@ -1,12 +1,20 @@
 #! /bin/bash
 echo "start testing"
 
+register_jose () {
+    curl -H "Content-Type: application/json" \
+         -X POST \
+         -d '{"user": "jose", "password": "maria1234"}' \
+         localhost:8080/users | jq;
+}
 login_jose () {
-    curl -X POST -u jose:maria localhost:8080/login | jq;
+    register_jose
+    TOKEN=$(curl -s -X POST -u jose:maria1234 localhost:8080/login | \
+            jq -r .token);
 }
 logout_jose() {
     curl -X DELETE \
-         -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+         -H "Authorization: Bearer $TOKEN" \
          localhost:8080/logout | jq
 }
 
@@ -15,7 +23,7 @@ while test $# -gt 0; do
     --post-workloads)
         login_jose
         curl -H "Content-Type: application/json" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
             -X POST \
             -d '{"filter": "grayscale", "workload_name": "david"}' \
             localhost:8080/workloads | jq
@@ -25,7 +33,7 @@ while test $# -gt 0; do
     --get-workloads)
         login_jose
         curl -H "Content-Type: application/json" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
             -X GET \
             localhost:8080/workloads/1 | jq
         shift
@@ -33,7 +41,7 @@ while test $# -gt 0; do
     --post-images)
         login_jose
         curl -H "Content-Type: multipart/form-data" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
              -F "data=@test.png" \
              -F "workload_id=2" \
              -F "type=original" \
@@ -45,7 +53,7 @@ while test $# -gt 0; do
     --get-image)
         login_jose
         curl -H "Content-Type: application/json" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
             -X GET \
             localhost:8080/images/1 \
             --output file.png
@@ -55,7 +63,7 @@ while test $# -gt 0; do
     --get-images)
         login_jose
         curl -H "Content-Type: application/json" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
             -X GET \
             localhost:8080/images | jq
             logout_jose
@@ -64,7 +72,7 @@ while test $# -gt 0; do
     --get-status)
         login_jose
         curl -H "Content-Type: application/json" \
-             -H "Authorization: Bearer am9zZTptYXJpYQ==" \
+             -H "Authorization: Bearer $TOKEN" \
             -X GET \
             localhost:8080/status | jq
         logout_jose
@@ -0,0 +1,232 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims is the payload of our tokens, they are JWTs signed
+// with HS256 so we can validate them without looking them up
+type Claims struct {
+	Subject   string `json:"sub"`  // username
+	Role      string `json:"role"` // user, worker or admin
+	Type      string `json:"typ"`  // access, refresh or apikey
+	Id        string `json:"jti"`  // used to revoke the token
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+
+	Scopes []string `json:"-"` // only for api keys
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+var accessTTL = 15 * time.Minute
+var refreshTTL = 24 * time.Hour
+
+// the tokens are signed with DPIP_TOKEN_SECRET, if it's not set
+// a random secret is used, so tokens die when the api restarts
+var tokenSecret = loadSecret()
+
+// revoked tokens (by jti) and when they expire, after that
+// there's no need to remember them
+var revoked = make(map[string]int64)
+var revokedLock sync.Mutex
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString(
+	[]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// postRefresh exchanges a refresh token for a new access and
+// refresh token, the old refresh token can't be used again
+func postRefresh(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: POST /refresh requested")
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var refreshReq RefreshReq
+	json.Unmarshal(body, &refreshReq)
+	if refreshReq.RefreshToken == "" {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+
+	claims, err := checkToken(refreshReq.RefreshToken, "refresh")
+	if err != nil {
+		returnError(w, r, 401, err.Error())
+		return
+	}
+	// checkToken saw it wasnt revoked, but the same token could be
+	// in another request right now, only one of them gets new tokens
+	if !revokeToken(claims) {
+		returnError(w, r, 401, "token has been revoked, "+
+			"please login again")
+		return
+	}
+
+	// the role could have changed since the last login
+	account, exists := searchAccount(claims.Subject)
+	if !exists {
+		returnError(w, r, 401, "your account was removed")
+		return
+	}
+	login, err := newLogin(account.Username, account.Role)
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create token")
+		return
+	}
+	login.Message = "Hi " + claims.Subject + ", here are your new tokens"
+	json.NewEncoder(w).Encode(login)
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postRefresh(w, r) // post
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+func loadSecret() []byte {
+	if secret := os.Getenv("DPIP_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	fmt.Println("[WARN] DPIP_TOKEN_SECRET not set, using a random " +
+		"secret, tokens will be invalid after a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		die("can't generate token secret: %s", err.Error())
+	}
+	return secret
+}
+
+// newLogin creates an access and a refresh token for the user
+func newLogin(username string, role string) (LoginResponse, error) {
+	var login LoginResponse
+	var err error
+	login.Token, err = signToken(username, role, "access", accessTTL)
+	if err != nil {
+		return login, err
+	}
+	login.RefreshToken, err = signToken(username, role, "refresh",
+		refreshTTL)
+	if err != nil {
+		return login, err
+	}
+	login.ExpiresIn = int(accessTTL.Seconds())
+	return login, nil
+}
+
+func signToken(username string, role string, tokenType string,
+	ttl time.Duration) (string, error) {
+	id, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		Subject:   username,
+		Role:      role,
+		Type:      tokenType,
+		Id:        id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(unsigned), nil
+}
+
+func sign(unsigned string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkToken validates signature, type, expiration and that the
+// token hasn't been revoked, then returns its claims
+func checkToken(token string, tokenType string) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errors.New("token not valid, " +
+			"please provide a valid one")
+	}
+	if !hmac.Equal([]byte(sign(parts[0]+"."+parts[1])),
+		[]byte(parts[2])) {
+		return claims, errors.New("token not valid, " +
+			"please provide a valid one")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("token not valid, " +
+			"please provide a valid one")
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("token not valid, " +
+			"please provide a valid one")
+	}
+	if claims.Type != tokenType {
+		return claims, errors.New("you sent a " + claims.Type +
+			" token, this endpoint only takes " + tokenType + " tokens")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired, " +
+			"use your refresh token in POST /refresh")
+	}
+	if isRevoked(claims.Id) {
+		return claims, errors.New("token has been revoked, " +
+			"please login again")
+	}
+	return claims, nil
+}
+
+// revokeToken remembers the jti until the token expires, it's
+// false if the token was already revoked
+func revokeToken(claims Claims) bool {
+	revokedLock.Lock()
+	defer revokedLock.Unlock()
+
+	if _, exists := revoked[claims.Id]; exists {
+		return false
+	}
+	now := time.Now().Unix()
+	for id, expiresAt := range revoked {
+		if expiresAt <= now {
+			delete(revoked, id)
+		}
+	}
+	revoked[claims.Id] = claims.ExpiresAt
+	return true
+}
+
+func isRevoked(id string) bool {
+	revokedLock.Lock()
+	defer revokedLock.Unlock()
+	_, exists := revoked[id]
+	return exists
+}
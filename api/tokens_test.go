@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckToken(t *testing.T) {
+	expired, err := signToken("ana", roleUser, "access", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, _ := signToken("ana", roleUser, "access", time.Minute)
+	refresh, _ := signToken("ana", roleUser, "refresh", time.Minute)
+	parts := strings.Split(access, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+	revokedToken, _ := signToken("ana", roleUser, "access", time.Minute)
+	claims, _ := checkToken(revokedToken, "access")
+	revokeToken(claims)
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenType string
+		valid     bool
+	}{
+		{"access", access, "access", true},
+		{"refresh", refresh, "refresh", true},
+		{"wrong type", refresh, "access", false},
+		{"expired", expired, "access", false},
+		{"tampered", tampered, "access", false},
+		{"revoked", revokedToken, "access", false},
+		{"not a jwt", "hello", "access", false},
+		{"empty", "", "access", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := checkToken(test.token, test.tokenType)
+			if (err == nil) != test.valid {
+				t.Fatalf("valid = %v, want %v (%v)", err == nil,
+					test.valid, err)
+			}
+			if test.valid && claims.Subject != "ana" {
+				t.Errorf("subject = %q, want ana", claims.Subject)
+			}
+		})
+	}
+}
+
+// refresh sends the refresh token to postRefresh, returns the status
+// and the new tokens
+func refresh(t *testing.T, token string) (int, LoginResponse) {
+	body, _ := json.Marshal(RefreshReq{RefreshToken: token})
+	r := httptest.NewRequest("POST", "/refresh",
+		strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	postRefresh(w, r)
+	var login LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &login)
+	return w.Code, login
+}
+
+func TestRefresh(t *testing.T) {
+	testAccounts(t)
+	first, err := newLogin("ana", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, _ := newLogin("gone", roleUser)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"refresh token", first.RefreshToken, 200},
+		{"used again", first.RefreshToken, 401},
+		{"access token", first.Token, 401},
+		{"account removed", gone.RefreshToken, 401},
+		{"missing", "", 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, login := refresh(t, test.token)
+			if status != test.status {
+				t.Fatalf("got %d, want %d", status, test.status)
+			}
+			if status != 200 {
+				return
+			}
+			// the new ones work, the new refresh token too
+			if _, err := checkToken(login.Token, "access"); err != nil {
+				t.Errorf("new access token: %v", err)
+			}
+			if status, _ := refresh(t, login.RefreshToken); status != 200 {
+				t.Errorf("new refresh token got %d", status)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	testAccounts(t)
+	router := testRouter()
+	login, _ := newLogin("ana", roleUser)
+	second, _ := newLogin("ana", roleUser)
+	other, _ := newLogin("root", roleAdmin)
+
+	// the refresh token of somebody else is not revoked
+	logout(t, login.Token, other.RefreshToken)
+	logout(t, second.Token, second.RefreshToken)
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenType string
+		revoked   bool
+	}{
+		{"access token", login.Token, "access", true},
+		{"its refresh token", second.RefreshToken, "refresh", true},
+		{"refresh token not sent", login.RefreshToken, "refresh", false},
+		{"other access token", other.Token, "access", false},
+		{"other refresh token", other.RefreshToken, "refresh", false},
+	}
+	for _, test := range tests {
+		_, err := checkToken(test.token, test.tokenType)
+		if (err != nil) != test.revoked {
+			t.Errorf("%s: revoked = %v, want %v", test.name, err != nil,
+				test.revoked)
+		}
+	}
+
+	// and the access token cant be used anymore
+	r := httptest.NewRequest("GET", "/workloads", nil)
+	r.Header.Set("Authorization", "Bearer "+login.Token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Errorf("revoked token got %d, want 401", w.Code)
+	}
+}
+
+func logout(t *testing.T, token string, refreshToken string) {
+	claims, err := checkToken(token, "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(RefreshReq{RefreshToken: refreshToken})
+	r := httptest.NewRequest("DELETE", "/logout",
+		strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	delLogout(w, withPrincipal(r, claims))
+	if w.Code != 200 {
+		t.Fatalf("logout got %d", w.Code)
+	}
+}
+
+func TestRefreshAtOnce(t *testing.T) {
+	testAccounts(t)
+	login, _ := newLogin("ana", roleUser)
+
+	// the same refresh token sent many times at once only works once
+	tries := 20
+	status := make(chan int)
+	for i := 0; i < tries; i++ {
+		go func() {
+			code, _ := refresh(t, login.RefreshToken)
+			status <- code
+		}()
+	}
+	count := map[int]int{}
+	for i := 0; i < tries; i++ {
+		count[<-status] += 1
+	}
+	if count[200] != 1 || count[401] != tries-1 {
+		t.Errorf("got %v, want one 200 and %d 401", count, tries-1)
+	}
+
+	// and whoever revokes it second knows it
+	claims, _ := checkToken(login.Token, "access")
+	if !revokeToken(claims) || revokeToken(claims) {
+		t.Error("the token was revoked twice")
+	}
+}
@@ -0,0 +1,471 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook is a url we POST to when something happens to a workload,
+// or to any workload the user can see if WorkloadId is nil. The
+// body is signed with the secret (see sendPayload), the secret is
+// only shown when the webhook is created
+type Webhook struct {
+	Id         uint64    `json:"webhook_id"`
+	Owner      string    `json:"owner"`
+	Url        string    `json:"url"`
+	WorkloadId *uint64   `json:"workload_id,omitempty"`
+	Events     []string  `json:"events"`
+	Secret     string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type WebhookReq struct {
+	Url        string   `json:"url"`
+	WorkloadId *uint64  `json:"workload_id"`
+	Events     []string `json:"events"`
+}
+
+type WebhookResp struct {
+	Message string `json:"message"`
+	Secret  string `json:"secret"`
+	Webhook
+}
+
+// Delivery is one event sent (or being sent) to a webhook
+type Delivery struct {
+	Id           uint64     `json:"delivery_id"`
+	WebhookId    uint64     `json:"webhook_id"`
+	Event        string     `json:"event"`
+	Status       string     `json:"status"` // pending, delivered or failed
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"response_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+	Payload      Payload    `json:"payload"`
+}
+
+// Payload is the body of the POST to the webhook
+type Payload struct {
+	Event      string    `json:"event"`
+	DeliveryId uint64    `json:"delivery_id"`
+	WorkloadId uint64    `json:"workload_id"`
+	Status     string    `json:"status,omitempty"` // workload.completed
+	Images     int       `json:"images,omitempty"` // workload.completed
+	Job        *Event    `json:"job,omitempty"`    // job.failed
+	Time       time.Time `json:"time"`
+}
+
+var webhookEvents = map[string]bool{
+	"workload.completed": true,
+	"job.failed":         true,
+}
+
+var Webhooks []Webhook
+var Deliveries []Delivery
+var webhooksIds uint64
+var deliveriesIds uint64
+var webhooksLock sync.Mutex
+
+// retries of a delivery, waiting 1s, 2s, 4s... between them
+var maxAttempts = 6
+var firstBackoff = time.Second
+var maxDeliveries = 1000 // history kept for each webhook
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postWebhooks registers a webhook for a workload, or for all of
+// them if workload_id is not sent
+func postWebhooks(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: POST /webhooks requested")
+	claims := principal(r) // see authorize
+
+	// handle body request
+	body, _ := ioutil.ReadAll(r.Body)
+	var webhookReq WebhookReq
+	if err := json.Unmarshal(body, &webhookReq); err != nil {
+		returnError(w, r, 400, "bad request, "+
+			"json sent misspelled or missing field")
+		return
+	}
+	target, err := url.Parse(webhookReq.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") ||
+		target.Host == "" {
+		returnError(w, r, 400, "the url must be http or https")
+		return
+	}
+	if webhookReq.WorkloadId != nil &&
+		!workloadExists(claims, *webhookReq.WorkloadId) {
+		returnError(w, r, 404, "the workload id doesnt exists, "+
+			"please check again")
+		return
+	}
+	if len(webhookReq.Events) == 0 {
+		webhookReq.Events = []string{"workload.completed", "job.failed"}
+	}
+	for _, event := range webhookReq.Events {
+		if !webhookEvents[event] {
+			returnError(w, r, 400, "the event "+event+" isnt valid, "+
+				"try with workload.completed or job.failed")
+			return
+		}
+	}
+	secret, err := randomId()
+	if err != nil {
+		returnError(w, r, 500, "server internal error, "+
+			"couldnt create secret")
+		return
+	}
+
+	webhooksLock.Lock()
+	var webhook Webhook
+	webhook.Id = webhooksIds
+	webhooksIds += 1
+	webhook.Owner = claims.Subject
+	webhook.Url = webhookReq.Url
+	webhook.WorkloadId = webhookReq.WorkloadId
+	webhook.Events = webhookReq.Events
+	webhook.Secret = secret
+	webhook.CreatedAt = time.Now().UTC()
+	Webhooks = append(Webhooks, webhook)
+	webhooksLock.Unlock()
+
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(WebhookResp{
+		Message: "save the secret, you need it to check the " +
+			"X-DPIP-Signature header",
+		Secret:  secret,
+		Webhook: webhook,
+	})
+}
+
+// getWebhooks lists the webhooks of the user
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("[INFO]: GET /webhooks requested")
+	claims := principal(r) // see authorize
+
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	webhooks := []Webhook{}
+	for _, webhook := range Webhooks {
+		if webhook.Owner == claims.Subject {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// delWebhooks removes a webhook, pending retries are dropped
+func delWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhookId, ok := ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for i, webhook := range Webhooks {
+		if webhook.Id == webhookId {
+			Webhooks = append(Webhooks[:i], Webhooks[i+1:]...)
+			break
+		}
+	}
+	returnMsg(w, "the webhook "+strconv.FormatUint(webhookId, 10)+
+		" has been removed")
+}
+
+// getDeliveries shows the deliveries of a webhook, newest first
+func getDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookId, ok := ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	deliveries := []Delivery{}
+	for i := len(Deliveries) - 1; i >= 0; i-- {
+		if Deliveries[i].WebhookId == webhookId {
+			deliveries = append(deliveries, Deliveries[i])
+		}
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getWebhooks(w, r) // get
+	case http.MethodPost:
+		postWebhooks(w, r) // post
+	case http.MethodDelete:
+		delWebhooks(w, r) // delete
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+func handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getDeliveries(w, r) // get
+	default:
+		returnError(w, r, 405, "method not allowed")
+	}
+
+}
+
+/********************* Helper Functions ***************************/
+
+func ownedWebhook(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	claims := principal(r) // see authorize
+	id := mux.Vars(r)["webhook_id"]
+	fmt.Println("[INFO]: " + r.Method + " " + r.URL.Path + " requested")
+	webhookId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		returnError(w, r, 400, "you didnt send a valid number, "+
+			"please check again")
+		return 0, false
+	}
+
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for _, webhook := range Webhooks {
+		if webhook.Id == webhookId && webhook.Owner == claims.Subject {
+			return webhookId, true
+		}
+	}
+	returnError(w, r, 404, "the webhook id doesnt exists")
+	return 0, false
+}
+
+// workloads that already sent workload.completed, the duplicated
+// jobs (see scheduler/stragglers.go) finish more than once.
+// pushPending takes the workload out when it gets new images
+var completed = make(map[uint64]bool)
+var completedLock sync.Mutex
+
+// markCompleted is true the first time, false if it was already
+// completed
+func markCompleted(workloadId uint64) bool {
+	completedLock.Lock()
+	defer completedLock.Unlock()
+	if completed[workloadId] {
+		return false
+	}
+	completed[workloadId] = true
+	return true
+}
+
+func markPending(workloadId uint64) {
+	completedLock.Lock()
+	defer completedLock.Unlock()
+	delete(completed, workloadId)
+}
+
+// notifyWebhooks is called with every job event from the
+// controller, a failed job (or one that ran out of time) is a
+// job.failed, and when a job ends, failed or not, and the workload
+// has nothing left it's completed, only once until it gets more
+// images
+func notifyWebhooks(event Event) {
+	workload, exists := searchWorkload(event.WorkloadId)
+	if !exists {
+		return
+	}
+	var payload Payload
+	payload.WorkloadId = workload.Id
+	payload.Time = time.Now().UTC()
+	switch event.Type {
+	case "job-failed", "job-timeout":
+		payload.Event = "job.failed"
+		payload.Job = &event
+		queueDeliveries(payload, workload)
+	case "job-finished":
+	default:
+		return
+	}
+
+	if !isActive(workload) || backlog(workload) > 0 ||
+		!markCompleted(workload.Id) {
+		return
+	}
+	payload.Event = "workload.completed"
+	payload.Job = nil
+	payload.Status = workload.Status
+	payload.Images = len(workload.Images)
+	queueDeliveries(payload, workload)
+}
+
+// queueDeliveries creates a delivery of the payload for every
+// webhook that wants it and sends them in the background
+func queueDeliveries(payload Payload, workload Workload) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for _, webhook := range Webhooks {
+		if !webhook.wants(payload.Event, workload) {
+			continue
+		}
+		var delivery Delivery
+		delivery.Id = deliveriesIds
+		deliveriesIds += 1
+		delivery.WebhookId = webhook.Id
+		delivery.Event = payload.Event
+		delivery.Status = "pending"
+		delivery.CreatedAt = payload.Time
+		delivery.Payload = payload
+		delivery.Payload.DeliveryId = delivery.Id
+		Deliveries = append(Deliveries, delivery)
+		go deliver(webhook, delivery)
+	}
+	trimDeliveries()
+}
+
+func (webhook Webhook) wants(event string, workload Workload) bool {
+	subscribed := false
+	for _, tmp := range webhook.Events {
+		if tmp == event {
+			subscribed = true
+		}
+	}
+	if !subscribed {
+		return false
+	}
+	if webhook.WorkloadId != nil {
+		return *webhook.WorkloadId == workload.Id
+	}
+	account, exists := searchAccount(webhook.Owner)
+	return exists && canSee(Claims{Subject: account.Username,
+		Role: account.Role}, workload)
+}
+
+// deliver POSTs the payload until the receiver answers 2xx, waiting
+// more after every failure, and keeps the result in the history
+func deliver(webhook Webhook, delivery Delivery) {
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return
+	}
+	backoff := firstBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if !webhookExists(webhook.Id) {
+			updateDelivery(delivery.Id, func(d *Delivery) {
+				d.Status = "failed"
+				d.Error = "the webhook was removed"
+			})
+			return
+		}
+
+		code, err := sendPayload(webhook, delivery, body)
+		updateDelivery(delivery.Id, func(d *Delivery) {
+			d.Attempts = attempt
+			d.ResponseCode = code
+			d.Error = ""
+			if err != nil {
+				d.Error = err.Error()
+			}
+		})
+		if err == nil {
+			now := time.Now().UTC()
+			updateDelivery(delivery.Id, func(d *Delivery) {
+				d.Status = "delivered"
+				d.DeliveredAt = &now
+			})
+			return
+		}
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	fmt.Println("[WARN] webhook " + strconv.FormatUint(webhook.Id, 10) +
+		" failed after " + strconv.Itoa(maxAttempts) + " attempts")
+	updateDelivery(delivery.Id, func(d *Delivery) {
+		d.Status = "failed"
+	})
+}
+
+// sendPayload sends the body signed with the secret of the webhook, the
+// receiver checks X-DPIP-Signature = "sha256=" + hex(hmac(body))
+func sendPayload(webhook Webhook, delivery Delivery, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DPIP-Webhook")
+	req.Header.Set("X-DPIP-Event", delivery.Event)
+	req.Header.Set("X-DPIP-Delivery", strconv.FormatUint(delivery.Id, 10))
+	req.Header.Set("X-DPIP-Signature", "sha256="+
+		hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the receiver answered %s",
+			resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookExists(id uint64) bool {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for _, webhook := range Webhooks {
+		if webhook.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func updateDelivery(id uint64, update func(*Delivery)) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for i := range Deliveries {
+		if Deliveries[i].Id == id {
+			update(&Deliveries[i])
+			return
+		}
+	}
+}
+
+// trimDeliveries forgets the oldest deliveries that are done, so
+// the history doesnt grow forever. webhooksLock must be held
+func trimDeliveries() {
+	if len(Deliveries) <= maxDeliveries*(len(Webhooks)+1) {
+		return
+	}
+	var deliveries []Delivery
+	extra := len(Deliveries) - maxDeliveries*(len(Webhooks)+1)
+	for _, delivery := range Deliveries {
+		if extra > 0 && delivery.Status != "pending" {
+			extra -= 1
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	Deliveries = deliveries
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+// authors: bsantanad & renataaparicio
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWorkloadCompleted(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+	t.Cleanup(receiver.Close)
+
+	ended := func(eventType string, imageId uint64) Event {
+		return Event{Type: eventType, JobId: imageId, WorkloadId: 0,
+			ImageId: imageId, Filter: "blur"}
+	}
+	tests := []struct {
+		name     string
+		assigned map[uint64]string // images waiting, and their filter
+		events   []Event
+		want     []string // deliveries
+	}{
+		{"all filtered", map[uint64]string{0: "blur", 1: "blur"},
+			[]Event{ended("job-finished", 0), ended("job-finished", 1)},
+			[]string{"workload.completed"}},
+		{"last job failed", map[uint64]string{0: "blur", 1: "blur"},
+			[]Event{ended("job-finished", 0), ended("job-failed", 1)},
+			[]string{"job.failed", "workload.completed"}},
+		{"first job timed out", map[uint64]string{0: "blur", 1: "blur"},
+			[]Event{ended("job-timeout", 0), ended("job-finished", 1)},
+			[]string{"job.failed", "workload.completed"}},
+		{"still filtering", map[uint64]string{0: "blur", 1: "blur"},
+			[]Event{ended("job-started", 0), ended("job-finished", 1)},
+			nil},
+		{"sent again with another filter",
+			map[uint64]string{0: "grayscale"},
+			[]Event{ended("job-failed", 0)},
+			[]string{"job.failed"}},
+		{"only once", map[uint64]string{0: "blur"},
+			[]Event{ended("job-finished", 0), ended("job-finished", 0)},
+			[]string{"workload.completed"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetState(t)
+			workloadId := uint64(0)
+			Workloads = []Workload{{Id: 0, Owner: "ana", Status: "running",
+				Filter: "blur", Images: []uint64{0, 1}}}
+			workloadsIds = 1
+			Webhooks = []Webhook{{Id: 0, Owner: "ana", Url: receiver.URL,
+				WorkloadId: &workloadId,
+				Events:     []string{"workload.completed", "job.failed"}}}
+			for id, filter := range test.assigned {
+				assign(id, filter)
+			}
+
+			for _, event := range test.events {
+				dispatchEvent(event)
+			}
+			var got []string
+			webhooksLock.Lock()
+			for _, delivery := range Deliveries {
+				got = append(got, delivery.Event)
+			}
+			webhooksLock.Unlock()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("deliveries %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// the events of the controller come while the handlers change the
+// same workload, run with -race
+func TestEventsWhileChanging(t *testing.T) {
+	resetState(t)
+	controller := testController(t)
+	setAccounts(Account{Username: "ana", Role: roleUser})
+	Workloads = []Workload{{Id: 0, Owner: "ana", Status: "completed",
+		Filter: "blur", Images: []uint64{0}}}
+	workloadsIds = 1
+	ana := Claims{Subject: "ana", Role: roleUser}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			dispatchEvent(Event{Type: "job-finished", WorkloadId: 0,
+				ImageId: 0, Filter: "blur"})
+		}
+		done <- true
+	}()
+	for i, handler := range []func(http.ResponseWriter,
+		*http.Request){postPause, postResume, postPause, postResume} {
+		r := httptest.NewRequest("POST", "/workloads/0/pause", nil)
+		r = mux.SetURLVars(withPrincipal(r, ana),
+			map[string]string{"workload_id": "0"})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != 200 {
+			t.Fatalf("request %d got %d: %s", i, w.Code, w.Body.String())
+		}
+		controller.Recv()
+	}
+	<-done
+	if workload, _ := searchWorkload(0); workload.Status != "completed" {
+		t.Errorf("status %q, want completed", workload.Status)
+	}
+}
@@ -1,13 +1,14 @@
 package controller
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"go.nanomsg.org/mangos"
@@ -21,12 +22,24 @@ import (
 
 // shared structs
 type Workload struct {
-	Id          uint64   `json:"workload_id"`
-	Filter      string   `json:"filter"`
-	Name        string   `json:"workload_name"`
-	Status      string   `json:"status"`
-	RunningJobs int      `json:"running_jobs"`
-	Images      []uint64 `json:"filtered_images"`
+	Id          uint64         `json:"workload_id"`
+	Filter      string         `json:"filter"`
+	Name        string         `json:"workload_name"`
+	Status      string         `json:"status"`
+	RunningJobs int            `json:"running_jobs"`
+	Images      []uint64       `json:"filtered_images"`
+	Owner       string         `json:"owner"`
+	Priority    string         `json:"priority"`
+	Deadline    time.Time      `json:"deadline"`
+	Pending     []PendingImage `json:"pending_images,omitempty"`
+	Dropped     []uint64       `json:"dropped_images,omitempty"` // deleted images
+	Action      string         `json:"action,omitempty"`         // update, cancel, delete, pause, resume, drop
+}
+
+type PendingImage struct {
+	Id     uint64 `json:"image_id"`
+	Filter string `json:"filter,omitempty"` // overrides the workload's
+	Pixels uint64 `json:"pixels,omitempty"`
 }
 
 type Image struct {
@@ -37,43 +50,74 @@ type Image struct {
 	Size       int    `json:"size"`
 }
 type Worker struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
-	Cpu   uint64 `json:"cpu"`
-	Id    uint64 `json:"id"`
-	Url   string `json:"url"`
-	Api   string `json:"api"`
+	Name    string `json:"name"`
+	Token   string `json:"token"`
+	Refresh string `json:"refresh_token"`
+	Cpu     uint64 `json:"cpu"`
+	Id      uint64 `json:"id"`
+	Url     string `json:"url"`
+	Api     string `json:"api"`
+
+	lastSeen time.Time // last heartbeat, see membership.go
+	gone     bool
 }
 
 type LoginResponse struct {
-	Message string `json:"message"`
-	Token   string `json:"token"`
+	Message      string `json:"message"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
+// Job is sent to the scheduler, with action "cancel" it tells the
+// scheduler to drop the jobs of the workload, with "drop" the ones
+// of the image (it was deleted), with "pause" to keep
+// them in the queue until "resume". The workers are not in the job,
+// the scheduler gets them from the membership feed
+// (see membership.go)
 type Job struct {
-	Filter  string   `json:"filter"`
-	ImageId uint64   `json:"image_id"`
-	Workers []Worker `json:"workers"`
+	Id         uint64    `json:"job_id"`
+	Filter     string    `json:"filter"`
+	ImageId    uint64    `json:"image_id"`
+	Pixels     uint64    `json:"pixels"` // the scheduler uses it for the timeout
+	WorkloadId uint64    `json:"workload_id"`
+	Owner      string    `json:"owner"`    // jobs are shared fairly between owners
+	Priority   string    `json:"priority"` // interactive, normal or batch
+	Deadline   time.Time `json:"deadline"` // zero if there's none
+	Action     string    `json:"action,omitempty"`
+	Epoch      string    `json:"epoch"` // see epoch
 }
 
 // end shared structs
 
 // fake database
 var Workloads []Workload
-var Workers []Worker
+var Workers []Worker // by id, the ones that left are marked gone
+var workersLock sync.Mutex
+
+// jobs of paused workloads, they are sent when it's resumed
+var held = make(map[uint64][]Job)
 
 // id manager
 var workersIds uint64
 
+// changes every time the controller starts, the ids of the jobs
+// start again so the scheduler drops the jobs of other epochs it
+// has in its queue log, and we ignore their events
+var epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
 var apiUrl = "http://localhost:8080"
 var workloadsUrl = "tcp://localhost:40899"
 var workersUrl = "tcp://localhost:40901"
 var schedulerUrl = "tcp://localhost:40902"
 
+// sent to the api to register workers, same as DPIP_CLUSTER_KEY there
+var clusterKey string // see loadClusterKey
+
 // PIPELINE listen for workloads sent by either
 // postWorkloads or postImages, if the workload
-// has jobs, push them to via PIPELINE to the
-// scheduler
+// has pending images, push one job for each of them
+// via PIPELINE to the scheduler. Cancelled and deleted
+// workloads tell the scheduler to drop their jobs
 func receiveWorkloads() {
 	var sock mangos.Socket
 	var err error
@@ -100,15 +144,26 @@ func receiveWorkloads() {
 			fmt.Println("[ERROR] controller couldnt parse to image\n" +
 				"bad json sent")
 		}
-		instertWorkload(workload)
+		jobs := checkForWork(workload)
+		action := workload.Action
+		workload.Pending = nil
+		workload.Action = ""
+		instertWorkload(withoutDropped(workload))
+		jobs = applyAction(workload, action, jobs)
+		if len(jobs) == 0 {
+			continue
+		}
 
-		job := checkForWork(workload)
-		job.Workers = Workers
-		jobStr, err := json.Marshal(job)
-		if err != nil {
-			die("cannot parse job to json string: %s", err.Error())
+		var jobsStr []string
+		for _, job := range jobs {
+			job.Epoch = epoch
+			jobStr, err := json.Marshal(job)
+			if err != nil {
+				die("cannot parse job to json string: %s", err.Error())
+			}
+			jobsStr = append(jobsStr, string(jobStr))
 		}
-		pushJob(schedulerUrl, string(jobStr))
+		pushJobs(schedulerUrl, jobsStr)
 	}
 }
 
@@ -136,11 +191,14 @@ func listenWorkers() {
 		}
 		var worker Worker
 		err = json.Unmarshal(msg, &worker)
-		// update cpu usage
+		// update cpu usage, it's also the heartbeat of the worker
 		if worker.Name == "" {
-			fmt.Println("[INFO] updating cpu usage\n")
-			Workers[worker.Id].Cpu = worker.Cpu
-			err = sock.Send([]byte("cpu_cool"))
+			reply := "cpu_cool"
+			if !heartbeat(worker.Id, worker.Cpu) {
+				// we restarted and forgot it, it has to join again
+				reply = "unknown_worker"
+			}
+			err = sock.Send([]byte(reply))
 			if err != nil {
 				die("can't send reply: %s", err.Error())
 			}
@@ -153,12 +211,20 @@ func listenWorkers() {
 			continue
 		}
 		fmt.Println("[INFO] worker: " + worker.Name + " has requested a token")
-		worker.Token = getCredentials(worker.Name)
+		workersLock.Lock()
 		worker.Id = workersIds
-		worker.Api = apiUrl
 		workersIds++
+		workersLock.Unlock()
+		// names can be repeated, the api user has the id too
+		worker.Token, worker.Refresh = getCredentials(worker.Name + "-" +
+			strconv.FormatUint(worker.Id, 10))
+		worker.Api = apiUrl
 
+		workersLock.Lock()
+		worker.lastSeen = time.Now()
 		Workers = append(Workers, worker)
+		workersLock.Unlock()
+		publishMembership()
 
 		workerStr, err := json.Marshal(worker)
 		if err != nil {
@@ -172,8 +238,9 @@ func listenWorkers() {
 	}
 }
 
-// send job via PIPELINE to the scheduler
-func pushJob(url string, msg string) {
+// send jobs via PIPELINE to the scheduler, all of them
+// use the same socket
+func pushJobs(url string, msgs []string) {
 	var sock mangos.Socket
 	var err error
 
@@ -183,33 +250,64 @@ func pushJob(url string, msg string) {
 	if err = sock.Dial(url); err != nil {
 		die("can't dial on push socket: %s", err.Error())
 	}
-	if err = sock.Send([]byte(msg)); err != nil {
-		die("can't send message on push socket: %s", err.Error())
+	for _, msg := range msgs {
+		if err = sock.Send([]byte(msg)); err != nil {
+			die("can't send message on push socket: %s", err.Error())
+		}
 	}
 	time.Sleep(time.Second / 10)
 	sock.Close()
 }
 
-// make request POST /login endpoint
-func getCredentials(name string) string {
-	psswd := generatePassword(10)
+// register the worker with POST /workers, the api answers with
+// its access and refresh tokens
+func getCredentials(name string) (string, string) {
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", apiUrl+"/login", nil)
-	req.Header.Add("Authorization", "Basic "+basicAuth(name, psswd))
+
+	account, err := json.Marshal(map[string]string{
+		"user": name,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return "", ""
+	}
+	req, err := http.NewRequest("POST", apiUrl+"/workers",
+		bytes.NewReader(account))
+	if err != nil {
+		fmt.Println(err)
+		return "", ""
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Cluster-Key", clusterKey)
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
-		return ""
+		return "", ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		fmt.Println("[ERROR] controller couldnt register worker " + name +
+			": " + resp.Status)
+		return "", ""
 	}
 	bodyText, err := ioutil.ReadAll(resp.Body)
-	//jsony := string(bodyText)
 	var login LoginResponse
 	err = json.Unmarshal(bodyText, &login)
 	if err != nil {
-		fmt.Println("[ERROR] controller couldnt parse login response\n")
-		return ""
+		fmt.Println("[ERROR] controller couldnt parse login response")
+		return "", ""
 	}
-	return login.Token
+	return login.Token, login.RefreshToken
+}
+
+// the same key the api has, there's no default one
+func loadClusterKey() string {
+	key := os.Getenv("DPIP_CLUSTER_KEY")
+	if key == "" {
+		die("DPIP_CLUSTER_KEY not set, the api wont let us " +
+			"register workers")
+	}
+	return key
 }
 
 func die(format string, v ...interface{}) {
@@ -234,36 +332,89 @@ func instertWorkload(workload Workload) {
 	return
 }
 
-/********* http requests helper *******************/
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-func generatePassword(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// applyAction returns what has to be sent to the scheduler after
+// the workload changed. Cancel and delete drop the jobs, drop only
+// the ones of the deleted images, pause
+// holds the new jobs here and tells the scheduler to skip the
+// queued ones, resume releases all of them
+func applyAction(workload Workload, action string, jobs []Job) []Job {
+	id := workload.Id
+	if action != "" && action != "update" {
+		fmt.Println("[INFO] controller: workload " +
+			strconv.FormatUint(id, 10) + " " + action)
+	}
+	switch action {
+	case "cancel", "delete":
+		delete(held, id)
+		forgetJobs(id)
+		return []Job{{WorkloadId: id, Action: "cancel"}}
+	case "drop":
+		var drops []Job
+		for _, imageId := range workload.Dropped {
+			held[id] = withoutImage(held[id], imageId)
+			forgetImage(id, imageId)
+			drops = append(drops,
+				Job{WorkloadId: id, ImageId: imageId, Action: "drop"})
+		}
+		return drops
+	case "pause":
+		held[id] = append(held[id], jobs...)
+		return []Job{{WorkloadId: id, Action: "pause"}}
+	case "resume":
+		jobs = append([]Job{{WorkloadId: id, Action: "resume"}}, held[id]...)
+		delete(held, id)
+		return jobs
 	}
-	return string(b)
+	if workload.Status == "paused" {
+		held[id] = append(held[id], jobs...)
+		return nil
+	}
+	return jobs
 }
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return base64.StdEncoding.EncodeToString([]byte(auth))
+
+// the deleted images are only for applyAction
+func withoutDropped(workload Workload) Workload {
+	workload.Dropped = nil
+	return workload
 }
 
-// sends info for the creation of a job in main.go
-func checkForWork(load Workload) Job {
-	if len(load.Images) < 1 {
-		return Job{}
+func withoutImage(jobs []Job, imageId uint64) []Job {
+	var tmp []Job
+	for _, job := range jobs {
+		if job.ImageId != imageId {
+			tmp = append(tmp, job)
+		}
 	}
+	return tmp
+}
 
-	var job Job
-	job.Filter = load.Filter
-	job.ImageId = load.Images[len(load.Images)-1]
-	return job
+// sends info for the creation of the jobs in main.go,
+// one for every pending image in the workload
+func checkForWork(load Workload) []Job {
+	var jobs []Job
+	for _, pending := range load.Pending {
+		var job Job
+		job.Filter = load.Filter
+		if pending.Filter != "" {
+			job.Filter = pending.Filter
+		}
+		job.ImageId = pending.Id
+		job.Pixels = pending.Pixels
+		job.WorkloadId = load.Id
+		job.Owner = load.Owner
+		job.Priority = load.Priority
+		job.Deadline = load.Deadline
+		jobs = append(jobs, newJob(job))
+	}
+	return jobs
 }
 
 func Start() {
-	rand.Seed(time.Now().UnixNano())
 	//Jobs := make(chan scheduler.Job)
+	clusterKey = loadClusterKey()
+	startPublisher()
+	startMembership()
+	go receiveEvents()
 	go receiveWorkloads()
 	go listenWorkers()
 
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/pub"
+	"go.nanomsg.org/mangos/protocol/pull"
+)
+
+// Event is a change in the state of a job, the scheduler tells us
+// when a job starts and ends, we add the timings and publish them
+// for the api (GET /workloads/{id}/events)
+type Event struct {
+	// job-queued, job-started, job-finished, job-failed,
+	// job-timeout, job-duplicated
+	Type       string    `json:"type"`
+	JobId      uint64    `json:"job_id"`
+	WorkloadId uint64    `json:"workload_id"`
+	ImageId    uint64    `json:"image_id"`
+	Filter     string    `json:"filter"`
+	Worker     string    `json:"worker,omitempty"`
+	Time       time.Time `json:"time"`
+	WaitMs     int64     `json:"wait_ms,omitempty"`     // queued until started
+	DurationMs int64     `json:"duration_ms,omitempty"` // started until finished
+	TimeoutMs  int64     `json:"timeout_ms,omitempty"`  // time the worker had
+	Error      string    `json:"error,omitempty"`
+	Epoch      string    `json:"epoch,omitempty"` // of the job, see epoch
+}
+
+// state of the jobs that haven't finished
+type jobState struct {
+	job       Job
+	queuedAt  time.Time
+	startedAt time.Time
+}
+
+var jobs = make(map[uint64]*jobState)
+var jobsLock sync.Mutex
+var jobsIds uint64
+
+var eventsUrl = "tcp://localhost:40903"  // scheduler -> controller
+var publishUrl = "tcp://localhost:40904" // controller -> api
+
+var publisher mangos.Socket
+
+// newJob gives the job its id and publishes it as queued
+func newJob(job Job) Job {
+	jobsLock.Lock()
+	job.Id = jobsIds
+	jobsIds++
+	now := time.Now().UTC()
+	jobs[job.Id] = &jobState{job: job, queuedAt: now}
+	jobsLock.Unlock()
+
+	publish(Event{
+		Type:       "job-queued",
+		JobId:      job.Id,
+		WorkloadId: job.WorkloadId,
+		ImageId:    job.ImageId,
+		Filter:     job.Filter,
+		Time:       now,
+	})
+	return job
+}
+
+// forgetJobs drops the state of the jobs of a cancelled workload,
+// they wont start
+func forgetJobs(workloadId uint64) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for id, state := range jobs {
+		if state.job.WorkloadId == workloadId {
+			delete(jobs, id)
+		}
+	}
+}
+
+// forgetImage drops the state of the jobs of a deleted image
+func forgetImage(workloadId uint64, imageId uint64) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for id, state := range jobs {
+		if state.job.WorkloadId == workloadId &&
+			state.job.ImageId == imageId {
+			delete(jobs, id)
+		}
+	}
+}
+
+// PIPELINE receive the job events from the scheduler, update the
+// state of the job and publish the event with its timings
+func receiveEvents() {
+	var sock mangos.Socket
+	var err error
+	var msg []byte
+
+	if sock, err = pull.NewSocket(); err != nil {
+		die("can't get new pull socket: %s", err)
+	}
+	if err = sock.Listen(eventsUrl); err != nil {
+		die("can't listen on pull socket: %s", err.Error())
+	}
+	for {
+		msg, err = sock.Recv()
+		if err != nil {
+			die("cannot receive from mangos Socket: %s", err.Error())
+		}
+		var event Event
+		if err = json.Unmarshal(msg, &event); err != nil {
+			fmt.Println("[ERROR] controller couldnt parse event\n" +
+				"bad json sent")
+			continue
+		}
+		if event.Epoch != epoch {
+			// a job of before we started, the ids are not ours
+			continue
+		}
+		event.Epoch = ""
+
+		jobsLock.Lock()
+		state, exists := jobs[event.JobId]
+		if exists {
+			switch event.Type {
+			case "job-started":
+				state.startedAt = event.Time
+				event.WaitMs = event.Time.Sub(state.queuedAt).Milliseconds()
+			case "job-finished", "job-failed", "job-timeout":
+				if !state.startedAt.IsZero() {
+					event.DurationMs = event.Time.Sub(
+						state.startedAt).Milliseconds()
+				}
+				delete(jobs, event.JobId)
+			}
+		}
+		jobsLock.Unlock()
+		publish(event)
+	}
+}
+
+// PUBSUB the api subscribes to all the events
+func startPublisher() {
+	var err error
+	if publisher, err = pub.NewSocket(); err != nil {
+		die("can't get new pub socket: %s", err)
+	}
+	if err = publisher.Listen(publishUrl); err != nil {
+		die("can't listen on pub socket: %s", err.Error())
+	}
+}
+
+func publish(event Event) {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("[ERROR] controller couldnt marshal event")
+		return
+	}
+	if err = publisher.Send(msg); err != nil {
+		fmt.Println("[ERROR] controller couldnt publish event: " +
+			err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/pub"
+)
+
+// Member is what the scheduler knows of a worker, the tokens stay
+// here
+type Member struct {
+	Id   uint64 `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	Cpu  uint64 `json:"cpu"`
+}
+
+// Membership is the list of workers alive, it's sent whole every
+// time something changes and every few seconds, so a scheduler that
+// just started gets it soon
+type Membership struct {
+	Workers []Member  `json:"workers"`
+	Time    time.Time `json:"time"`
+}
+
+var membershipUrl = "tcp://localhost:40905" // controller -> scheduler
+
+var membership mangos.Socket
+
+var (
+	heartbeatTimeout = 15 * time.Second // workers beat every 5s
+	membershipEvery  = 5 * time.Second
+)
+
+// PUBSUB the scheduler subscribes to the workers
+func startMembership() {
+	var err error
+	if membership, err = pub.NewSocket(); err != nil {
+		die("can't get new pub socket: %s", err)
+	}
+	if err = membership.Listen(membershipUrl); err != nil {
+		die("can't listen on pub socket: %s", err.Error())
+	}
+	go watchWorkers()
+}
+
+// heartbeat updates the cpu of the worker and when we last heard
+// of it, false if we dont know that worker
+func heartbeat(id uint64, cpu uint64) bool {
+	workersLock.Lock()
+	if id >= uint64(len(Workers)) {
+		workersLock.Unlock()
+		return false
+	}
+	back := Workers[id].gone
+	name := Workers[id].Name
+	Workers[id].Cpu = cpu
+	Workers[id].lastSeen = time.Now()
+	Workers[id].gone = false
+	workersLock.Unlock()
+
+	if back {
+		fmt.Println("[INFO] controller: worker " + name + " is back")
+	}
+	publishMembership()
+	return true
+}
+
+// watchWorkers marks gone the workers that stopped beating, and
+// sends the membership every now and then
+func watchWorkers() {
+	for range time.Tick(membershipEvery) {
+		workersLock.Lock()
+		for i, worker := range Workers {
+			if worker.gone ||
+				time.Since(worker.lastSeen) < heartbeatTimeout {
+				continue
+			}
+			Workers[i].gone = true
+			fmt.Println("[INFO] controller: worker " + worker.Name + " (" +
+				strconv.FormatUint(worker.Id, 10) + ") stopped answering, " +
+				"removing it")
+		}
+		workersLock.Unlock()
+		publishMembership()
+	}
+}
+
+func publishMembership() {
+	var update Membership
+	update.Workers = []Member{}
+	workersLock.Lock()
+	for _, worker := range Workers {
+		if worker.gone {
+			continue
+		}
+		update.Workers = append(update.Workers, Member{
+			Id:   worker.Id,
+			Name: worker.Name,
+			Url:  worker.Url,
+			Cpu:  worker.Cpu,
+		})
+	}
+	workersLock.Unlock()
+	update.Time = time.Now().UTC()
+
+	msg, err := json.Marshal(update)
+	if err != nil {
+		fmt.Println("[ERROR] controller couldnt marshal membership")
+		return
+	}
+	if err = membership.Send(msg); err != nil {
+		fmt.Println("[ERROR] controller couldnt publish membership: " +
+			err.Error())
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"os"
 
 	"github.com/bsantanad/dc-final/api"
 	"github.com/bsantanad/dc-final/controller"
@@ -12,6 +15,18 @@ func main() {
 	log.Println("Welcome to the Distributed and " +
 		"Parallel Image Processing System")
 
+	// the api and the controller run here together, if no cluster key
+	// was set they share a random one, there's no default key
+	if os.Getenv("DPIP_CLUSTER_KEY") == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalln("can't generate cluster key: " + err.Error())
+		}
+		os.Setenv("DPIP_CLUSTER_KEY", hex.EncodeToString(key))
+		log.Println("DPIP_CLUSTER_KEY not set, using a random one " +
+			"for the api and the controller")
+	}
+
 	// Start Controller
 	go controller.Start()
 	go scheduler.Start()
@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/pub"
+)
+
+// QueueStats is published every second for the api, so it can stop
+// taking images when the workers can't keep up
+type QueueStats struct {
+	Depth    int       `json:"depth"`  // jobs waiting, the paused ones too
+	Paused   int       `json:"paused"` // jobs of paused workloads
+	Running  int       `json:"running"`
+	Workers  int       `json:"workers"`
+	WaitMs   int64     `json:"wait_ms"`  // for a job queued now
+	JobMs    int64     `json:"job_ms"`   // what a job takes on average
+	Dequeued uint64    `json:"dequeued"` // jobs that left the queue so far
+	Time     time.Time `json:"time"`
+}
+
+var statsUrl = "tcp://localhost:40906" // scheduler -> api
+var statsEvery = time.Second
+
+// how long a job takes, from the last ones that finished. Until
+// one finishes it's a guess
+var jobAvgMs = 1000.0
+var jobSmoothing = 0.1
+
+// recordJobTime updates the average with a job that finished.
+// Needs runningLock
+func recordJobTime(elapsed time.Duration) {
+	jobAvgMs = jobSmoothing*float64(elapsed.Milliseconds()) +
+		(1-jobSmoothing)*jobAvgMs
+}
+
+// PUBSUB the api subscribes to the stats of the queue
+func publishStats() {
+	var sock mangos.Socket
+	var err error
+
+	if sock, err = pub.NewSocket(); err != nil {
+		die("can't get new pub socket: %s", err)
+	}
+	if err = sock.Listen(statsUrl); err != nil {
+		die("can't listen on pub socket: %s", err.Error())
+	}
+	for range time.Tick(statsEvery) {
+		msg, err := json.Marshal(queueStats())
+		if err != nil {
+			fmt.Println("[ERROR] scheduler couldnt marshal stats")
+			continue
+		}
+		if err = sock.Send(msg); err != nil {
+			fmt.Println("[ERROR] scheduler couldnt publish stats: " +
+				err.Error())
+		}
+	}
+}
+
+// queueStats counts the jobs in the queue and running, the wait is
+// the jobs that will go before a new one split between the workers
+func queueStats() QueueStats {
+	var stats QueueStats
+	queueLock.Lock()
+	for _, f := range flows {
+		for _, job := range f.jobs {
+			stats.Depth++
+			if paused[job.WorkloadId] {
+				stats.Paused++
+			}
+		}
+	}
+	stats.Dequeued = dequeued
+	queueLock.Unlock()
+
+	runningLock.Lock()
+	stats.Running = len(running)
+	avg := jobAvgMs
+	runningLock.Unlock()
+
+	stats.Workers = len(members())
+	workers := stats.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	ahead := stats.Depth - stats.Paused + stats.Running
+	stats.WaitMs = int64(float64(ahead) * avg / float64(workers))
+	stats.JobMs = int64(avg)
+	stats.Time = time.Now().UTC()
+	return stats
+}
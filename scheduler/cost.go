@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// how many nanoseconds each filter takes per pixel, it starts with a
+// guess and learns from the jobs that finish. The overhead of every
+// job (see timeoutFor) is taken out before, or the small images
+// would make it look like the filter is much slower than it is
+var costs = map[string]float64{
+	"blur":      400,
+	"grayscale": 40,
+}
+var defaultCost = 400.0
+var costsLock sync.Mutex
+
+// weight of the last job in the cost
+var costSmoothing = 0.2
+
+var (
+	overhead       = 2 * time.Second  // dial, download and upload
+	safety         = 4.0              // a worker can be busier than usual
+	maxTimeout     = 10 * time.Minute // nothing takes this long
+	unknownTimeout = 30 * time.Second // we dont know the size
+)
+
+// timeoutFor is how long the worker has to filter the image of the
+// job, it grows with the pixels of the image and the cost of the
+// filter
+func timeoutFor(job Job) time.Duration {
+	if job.Pixels == 0 {
+		return unknownTimeout
+	}
+	costsLock.Lock()
+	cost, exists := costs[job.Filter]
+	costsLock.Unlock()
+	if !exists {
+		cost = defaultCost
+	}
+	timeout := overhead +
+		time.Duration(float64(job.Pixels)*cost*safety)*time.Nanosecond
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return timeout
+}
+
+// learnCost updates the cost of the filter with a job that took
+// elapsed, for a job that timed out it's what it took at least,
+// so the next ones get more time
+func learnCost(job Job, elapsed time.Duration) {
+	if job.Pixels == 0 {
+		return
+	}
+	filtering := elapsed - overhead
+	if filtering < 0 {
+		filtering = 0
+	}
+	sample := float64(filtering.Nanoseconds()) / float64(job.Pixels)
+	costsLock.Lock()
+	defer costsLock.Unlock()
+	cost, exists := costs[job.Filter]
+	if !exists {
+		costs[job.Filter] = sample
+		return
+	}
+	costs[job.Filter] = costSmoothing*sample + (1-costSmoothing)*cost
+}
+
+// isTimeout tells apart the jobs that ran out of time from the ones
+// that failed, the deadline can pass while connecting or while the
+// worker is filtering
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		status.Code(errors.Unwrap(err)) == codes.DeadlineExceeded
+}
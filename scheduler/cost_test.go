@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func resetCosts(t *testing.T) {
+	reset := func() {
+		costsLock.Lock()
+		costs = map[string]float64{"blur": 400, "grayscale": 40}
+		costsLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestTimeoutFor(t *testing.T) {
+	resetCosts(t)
+	tests := []struct {
+		name    string
+		job     Job
+		timeout time.Duration
+	}{
+		{"size unknown", Job{Filter: "blur"}, unknownTimeout},
+		{"blur", Job{Filter: "blur", Pixels: 1000000},
+			overhead + 1600*time.Millisecond},
+		{"grayscale", Job{Filter: "grayscale", Pixels: 1000000},
+			overhead + 160*time.Millisecond},
+		{"unknown filter", Job{Filter: "sepia", Pixels: 1000000},
+			overhead + 1600*time.Millisecond},
+		{"huge image", Job{Filter: "blur", Pixels: 1 << 40}, maxTimeout},
+	}
+	for _, test := range tests {
+		if got := timeoutFor(test.job); got != test.timeout {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.timeout)
+		}
+	}
+}
+
+func TestLearnCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     Job
+		elapsed time.Duration
+		filter  string
+		cost    float64
+	}{
+		{"overhead is not the filter", Job{Filter: "blur",
+			Pixels: 1000000}, overhead + 500*time.Millisecond, "blur",
+			0.2*500 + 0.8*400},
+		{"faster than the overhead", Job{Filter: "grayscale",
+			Pixels: 1000}, time.Second, "grayscale", 0.8 * 40},
+		{"new filter", Job{Filter: "sepia", Pixels: 1000000},
+			overhead + time.Second, "sepia", 1000},
+		{"size unknown", Job{Filter: "blur"}, time.Hour, "blur", 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetCosts(t)
+			learnCost(test.job, test.elapsed)
+			costsLock.Lock()
+			got := costs[test.filter]
+			costsLock.Unlock()
+			if got < test.cost-0.001 || got > test.cost+0.001 {
+				t.Errorf("cost %v, want %v", got, test.cost)
+			}
+		})
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		timeout bool
+	}{
+		{"no error", nil, false},
+		{"deadline while dialing", context.DeadlineExceeded, true},
+		{"deadline in the worker", fmt.Errorf("filter: %w",
+			status.Error(codes.DeadlineExceeded, "too slow")), true},
+		{"worker failed", fmt.Errorf("filter: %w",
+			status.Error(codes.Internal, "bad image")), false},
+		{"other error", errors.New("connection refused"), false},
+	}
+	for _, test := range tests {
+		if got := isTimeout(test.err); got != test.timeout {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.timeout)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the queue is backed by an append-only log, one json per line, so
+// a restart doesnt lose the jobs. Every job received is written
+// before it's queued, when it's sent to a worker it gets a lease
+// and when it ends (or is dropped) it's acked. On start the log is
+// read back, the jobs that weren't acked are queued again, the
+// leased ones once their lease expires (the worker may still be
+// filtering them, the api keeps only one image per job anyway).
+// The jobs carry the epoch of the controller that created them
+// (it changes every time it starts), they are only queued again if
+// the controller is still the same one, if it started again the
+// job, image and workload ids are not the same anymore
+type record struct {
+	Op    string    `json:"op"` // job, lease, ack
+	Seq   uint64    `json:"seq"`
+	Job   *Job      `json:"job,omitempty"`
+	Until time.Time `json:"until"` // lease only
+}
+
+// a job sent to a worker, if it's not acked by until it goes back
+// to the queue
+type lease struct {
+	job   Job
+	until time.Time
+}
+
+var journalPath = "scheduler-queue.log"
+var journal *os.File
+var journalLock sync.Mutex
+var journalSeq uint64
+
+var live = make(map[uint64]Job)     // by seq, not acked yet
+var leases = make(map[uint64]lease) // by seq
+
+// jobs read from the log, they wait for the first job of the
+// controller to know if they are still good (see adoptEpoch). The
+// until of the ones that weren't leased is zero. journalLock
+var recovered []lease
+
+// epoch of the controller the jobs come from, queueLock
+var epoch string
+var adopted bool // a job was received since we started
+
+var (
+	leaseGrace   = 30 * time.Second // on top of the timeout of the job
+	compactAfter = 10000            // records written before compacting
+	written      = 0
+)
+
+// loadJournal reads the log and keeps what wasn't acked until we
+// know the epoch of the controller. It runs before anything else in
+// the scheduler
+func loadJournal() {
+	if path := os.Getenv("DPIP_QUEUE_LOG"); path != "" {
+		journalPath = path
+	}
+
+	var records []record
+	if file, err := os.Open(journalPath); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// the last line can be half written if we died
+				fmt.Println("[WARN] scheduler: skipping bad line " +
+					"in the queue log")
+				continue
+			}
+			records = append(records, rec)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		die("can't open the queue log: %s", err.Error())
+	}
+
+	acked := make(map[uint64]bool)
+	leased := make(map[uint64]time.Time)
+	for _, rec := range records {
+		if rec.Seq > journalSeq {
+			journalSeq = rec.Seq
+		}
+		switch rec.Op {
+		case "ack":
+			acked[rec.Seq] = true
+		case "lease":
+			leased[rec.Seq] = rec.Until
+		}
+	}
+
+	var err error
+	if journal, err = os.OpenFile(journalPath,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		die("can't open the queue log: %s", err.Error())
+	}
+
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	for _, rec := range records {
+		if rec.Op != "job" || rec.Job == nil || acked[rec.Seq] {
+			continue
+		}
+		job := *rec.Job
+		job.seq = rec.Seq
+		recovered = append(recovered, lease{job: job, until: leased[job.seq]})
+	}
+	fmt.Println("[INFO] scheduler: " + strconv.Itoa(len(recovered)) +
+		" records recovered from the queue log, waiting for the " +
+		"controller")
+}
+
+// adoptEpoch is called with every job received before it's queued.
+// The first time, or when the controller started again, the jobs of
+// other epochs are dropped: the ones waiting in the queue, the ones
+// in the log and the state of the workloads. The jobs running finish
+// but the controller ignores their events. The recovered jobs of
+// this epoch are queued again
+func adoptEpoch(jobEpoch string) {
+	queueLock.Lock()
+	if adopted && jobEpoch == epoch {
+		queueLock.Unlock()
+		return
+	}
+	adopted = true
+	epoch = jobEpoch
+	cancelled = make(map[uint64]bool)
+	paused = make(map[uint64]bool)
+	stale := dropQueued(func(queued Job) bool {
+		return queued.Epoch != jobEpoch
+	})
+	queueLock.Unlock()
+
+	runningLock.Lock()
+	durations = make(map[uint64][]time.Duration)
+	runningLock.Unlock()
+
+	journalLock.Lock()
+	for seq, job := range live {
+		if job.Epoch != jobEpoch {
+			delete(live, seq)
+			delete(leases, seq)
+			write(record{Op: "ack", Seq: seq})
+			stale++
+		}
+	}
+	old := recovered
+	recovered = nil
+	journalLock.Unlock()
+
+	queued, waiting := 0, 0
+	for _, l := range old {
+		job := l.job
+		if job.Epoch != jobEpoch {
+			stale++
+			continue
+		}
+		if job.Action != "" {
+			// cancel, pause and resume rebuild the state
+			enqueue(job)
+			continue
+		}
+		journalLock.Lock()
+		live[job.seq] = job
+		if !l.until.IsZero() {
+			leases[job.seq] = l
+		}
+		journalLock.Unlock()
+		if !l.until.IsZero() {
+			waiting++
+			continue
+		}
+		enqueue(job)
+		queued++
+	}
+	compact()
+	if stale > 0 {
+		fmt.Println("[WARN] scheduler: the controller started again, " +
+			strconv.Itoa(stale) + " jobs of before were dropped")
+	}
+	fmt.Println("[INFO] scheduler: " + strconv.Itoa(queued) +
+		" jobs recovered from the queue log, " +
+		strconv.Itoa(waiting) + " waiting for their lease")
+}
+
+// journalJob writes the job before it's queued and gives it its seq
+func journalJob(job Job) Job {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	journalSeq++
+	job.seq = journalSeq
+	if job.Action == "" {
+		live[job.seq] = job
+	}
+	write(record{Op: "job", Seq: job.seq, Job: &job})
+	return job
+}
+
+// journalLease is called when the job is sent to a worker, a second
+// attempt (see stragglers.go) makes the lease longer
+func journalLease(job Job, timeout time.Duration) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	until := time.Now().Add(timeout + leaseGrace).UTC()
+	if current, exists := leases[job.seq]; exists &&
+		current.until.After(until) {
+		return
+	}
+	leases[job.seq] = lease{job: job, until: until}
+	write(record{Op: "lease", Seq: job.seq, Until: until})
+}
+
+// journalAck is called when the job ended or was dropped, it wont
+// come back after a restart
+func journalAck(job Job) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	if _, exists := live[job.seq]; !exists {
+		return
+	}
+	delete(live, job.seq)
+	delete(leases, job.seq)
+	write(record{Op: "ack", Seq: job.seq})
+}
+
+// write appends the record and syncs it to disk. Needs journalLock
+func write(rec record) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Println("[ERROR] scheduler: couldnt marshal log record")
+		return
+	}
+	if _, err = journal.Write(append(line, '\n')); err != nil {
+		fmt.Println("[ERROR] scheduler: couldnt write the queue log: " +
+			err.Error())
+		return
+	}
+	journal.Sync()
+	written++
+}
+
+// watchLeases sends back to the queue the jobs whose lease expired
+// and were not acked, and compacts the log once in a while
+func watchLeases() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		var expired []lease
+		journalLock.Lock()
+		for _, l := range leases {
+			if now.After(l.until) {
+				expired = append(expired, l)
+			}
+		}
+		needsCompact := written > compactAfter
+		journalLock.Unlock()
+
+		for _, l := range expired {
+			runningLock.Lock()
+			_, stillRunning := running[l.job.Id]
+			runningLock.Unlock()
+			if stillRunning {
+				journalLease(l.job, leaseGrace)
+				continue
+			}
+			journalLock.Lock()
+			delete(leases, l.job.seq)
+			journalLock.Unlock()
+			fmt.Println("[WARN] scheduler: lease of job " +
+				strconv.FormatUint(l.job.Id, 10) +
+				" expired, queueing it again")
+			enqueue(l.job)
+		}
+		if needsCompact {
+			compact()
+		}
+	}
+}
+
+// compact rewrites the log with only the jobs that weren't acked,
+// their leases, the workloads that are paused or cancelled and what
+// was recovered and is still waiting for adoptEpoch
+func compact() {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	tmpPath := journalPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		fmt.Println("[ERROR] scheduler: couldnt compact the queue log: " +
+			err.Error())
+		return
+	}
+	writer := bufio.NewWriter(tmp)
+	add := func(rec record) {
+		line, _ := json.Marshal(rec)
+		writer.Write(append(line, '\n'))
+	}
+
+	// the state of the workloads goes first so it applies to the
+	// jobs that come after
+	for id := range cancelled {
+		add(record{Op: "job", Job: &Job{WorkloadId: id, Action: "cancel",
+			Epoch: epoch}})
+	}
+	for id := range paused {
+		add(record{Op: "job", Job: &Job{WorkloadId: id, Action: "pause",
+			Epoch: epoch}})
+	}
+	for _, l := range recovered {
+		job := l.job
+		add(record{Op: "job", Seq: job.seq, Job: &job})
+		if !l.until.IsZero() {
+			add(record{Op: "lease", Seq: job.seq, Until: l.until})
+		}
+	}
+	seqs := make([]uint64, 0, len(live))
+	for seq := range live {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		job := live[seq]
+		add(record{Op: "job", Seq: seq, Job: &job})
+		if l, exists := leases[seq]; exists {
+			add(record{Op: "lease", Seq: seq, Until: l.until})
+		}
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, journalPath)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] scheduler: couldnt compact the queue log: " +
+			err.Error())
+		return
+	}
+	journal.Close()
+	if journal, err = os.OpenFile(journalPath,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		die("can't open the queue log: %s", err.Error())
+	}
+	written = 0
+}
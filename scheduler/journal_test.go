@@ -0,0 +1,233 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetJournal(t *testing.T) string {
+	resetQueue()
+	journalLock.Lock()
+	if journal != nil {
+		journal.Close()
+		journal = nil
+	}
+	live = make(map[uint64]Job)
+	leases = make(map[uint64]lease)
+	recovered = nil
+	journalSeq = 0
+	written = 0
+	journalLock.Unlock()
+	queueLock.Lock()
+	epoch = ""
+	adopted = false
+	queueLock.Unlock()
+
+	path := filepath.Join(t.TempDir(), "queue.log")
+	t.Setenv("DPIP_QUEUE_LOG", path)
+	t.Cleanup(func() {
+		journalLock.Lock()
+		defer journalLock.Unlock()
+		if journal != nil {
+			journal.Close()
+			journal = nil
+		}
+	})
+	return path
+}
+
+func writeLog(t *testing.T, path string, lines ...string) {
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func jobLine(seq uint64, id uint64, workloadId uint64, jobEpoch string,
+	action string) string {
+	job := Job{Id: id, ImageId: id, Filter: "blur", Owner: "ana",
+		Priority: "normal", WorkloadId: workloadId, Epoch: jobEpoch,
+		Action: action}
+	line, _ := json.Marshal(record{Op: "job", Seq: seq, Job: &job})
+	return string(line)
+}
+
+func opLine(op string, seq uint64, until time.Time) string {
+	line, _ := json.Marshal(record{Op: op, Seq: seq, Until: until})
+	return string(line)
+}
+
+// ids of the jobs in the queue
+func queuedIds() []uint64 {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	ids := []uint64{}
+	for _, f := range flows {
+		for _, job := range f.jobs {
+			ids = append(ids, job.Id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func readLog(t *testing.T, path string) []record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("bad line in the compacted log: %s", scanner.Text())
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestJournalReplay(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC()
+	log := func(jobEpoch string) []string {
+		return []string{
+			jobLine(1, 10, 0, jobEpoch, ""),
+			jobLine(2, 11, 0, jobEpoch, ""),
+			opLine("ack", 2, time.Time{}),
+			jobLine(3, 12, 0, jobEpoch, ""),
+			opLine("lease", 3, future),
+			jobLine(4, 0, 9, jobEpoch, "cancel"),
+			jobLine(5, 13, 9, jobEpoch, ""),
+			jobLine(6, 14, 1, jobEpoch, ""),
+			`{"op":"job","seq":7,"jo`, // died while writing
+		}
+	}
+
+	tests := []struct {
+		name    string
+		lines   []string
+		epoch   string
+		queued  []uint64
+		leased  []uint64 // job ids
+		live    int
+		maxSeq  uint64
+		records int // in the log after compacting
+	}{
+		{"same controller", log("e1"), "e1",
+			[]uint64{10, 14}, []uint64{12}, 3, 6, 5},
+		{"controller started again", log("e0"), "e1",
+			[]uint64{}, nil, 0, 6, 0},
+		{"no log", nil, "e1", []uint64{}, nil, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := resetJournal(t)
+			if test.lines != nil {
+				writeLog(t, path, test.lines...)
+			}
+			loadJournal()
+			if ids := queuedIds(); len(ids) != 0 {
+				t.Fatalf("%v queued before knowing the epoch", ids)
+			}
+			if journalSeq != test.maxSeq {
+				t.Errorf("seq = %d, want %d", journalSeq, test.maxSeq)
+			}
+
+			adoptEpoch(test.epoch)
+			if ids := queuedIds(); !reflect.DeepEqual(ids, test.queued) {
+				t.Errorf("queued %v, want %v", ids, test.queued)
+			}
+			var leased []uint64
+			journalLock.Lock()
+			for _, l := range leases {
+				leased = append(leased, l.job.Id)
+			}
+			liveJobs := len(live)
+			journalLock.Unlock()
+			if !reflect.DeepEqual(leased, test.leased) {
+				t.Errorf("leased %v, want %v", leased, test.leased)
+			}
+			if liveJobs != test.live {
+				t.Errorf("%d live jobs, want %d", liveJobs, test.live)
+			}
+
+			// the log was compacted to what is still live and the
+			// cancelled workload
+			records := readLog(t, path)
+			if len(records) != test.records {
+				t.Errorf("%d records after compacting, want %d: %+v",
+					len(records), test.records, records)
+			}
+			for _, rec := range records {
+				if rec.Job != nil && rec.Job.Epoch != test.epoch {
+					t.Errorf("record of epoch %q left in the log",
+						rec.Job.Epoch)
+				}
+			}
+
+			// new jobs continue the seq
+			job := journalJob(Job{Id: 20, Epoch: test.epoch})
+			if job.seq != test.maxSeq+1 {
+				t.Errorf("new seq = %d, want %d", job.seq, test.maxSeq+1)
+			}
+		})
+	}
+}
+
+func TestJournalNewEpoch(t *testing.T) {
+	resetJournal(t)
+	loadJournal()
+
+	// jobs of the first controller, one queued and one with a worker
+	adoptEpoch("e1")
+	enqueue(journalJob(Job{Id: 0, ImageId: 0, Filter: "blur",
+		Owner: "ana", WorkloadId: 0, Epoch: "e1"}))
+	leased := journalJob(Job{Id: 1, ImageId: 1, Filter: "blur",
+		Owner: "ana", WorkloadId: 0, Epoch: "e1"})
+	journalLease(leased, time.Minute)
+	enqueue(journalJob(Job{WorkloadId: 3, Action: "cancel", Epoch: "e1"}))
+
+	// same controller, nothing changes
+	adoptEpoch("e1")
+	if ids := queuedIds(); !reflect.DeepEqual(ids, []uint64{0}) {
+		t.Fatalf("queued %v, want [0]", ids)
+	}
+
+	// the controller started again, workload 3 is a new one now
+	adoptEpoch("e2")
+	enqueue(journalJob(Job{Id: 0, ImageId: 5, Filter: "blur",
+		Owner: "ana", WorkloadId: 3, Epoch: "e2"}))
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"queued", queuedIds(), []uint64{0}},
+		{"image of the new job", func() uint64 {
+			queueLock.Lock()
+			defer queueLock.Unlock()
+			for _, f := range flows {
+				return f.jobs[0].ImageId
+			}
+			return 0
+		}(), uint64(5)},
+		{"leases", len(leases), 0},
+		{"live", len(live), 1},
+		{"cancelled", len(cancelled), 0},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos"
+	"go.nanomsg.org/mangos/protocol/sub"
+)
+
+// Membership is the list of workers alive, the controller sends it
+// whole when a worker joins, leaves or its cpu changes, and every
+// few seconds (see controller/membership.go)
+type Membership struct {
+	Workers []Worker  `json:"workers"`
+	Time    time.Time `json:"time"`
+}
+
+var membershipUrl = "tcp://localhost:40905"
+
+var workers []Worker
+var workersLock sync.Mutex
+
+// members is a copy of the workers alive
+func members() []Worker {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+	tmp := make([]Worker, len(workers))
+	copy(tmp, workers)
+	return tmp
+}
+
+// PUBSUB receive the workers from the controller, the connections
+// of the ones that left are closed and dispatch is woken up in case
+// it was waiting for a worker
+func subscribeMembership() {
+	var sock mangos.Socket
+	var err error
+	var msg []byte
+
+	if sock, err = sub.NewSocket(); err != nil {
+		die("can't get new sub socket: %s", err.Error())
+	}
+	sock.SetOption(mangos.OptionDialAsynch, true)
+	if err = sock.Dial(membershipUrl); err != nil {
+		die("can't dial on sub socket: %s", err.Error())
+	}
+	if err = sock.SetOption(mangos.OptionSubscribe, []byte("")); err != nil {
+		die("can't subscribe: %s", err.Error())
+	}
+	for {
+		msg, err = sock.Recv()
+		if err != nil {
+			die("cannot receive from mangos Socket: %s", err.Error())
+		}
+		var update Membership
+		if err = json.Unmarshal(msg, &update); err != nil {
+			fmt.Println("[ERROR] scheduler couldnt parse membership")
+			continue
+		}
+
+		workersLock.Lock()
+		before := len(workers)
+		workers = update.Workers
+		workersLock.Unlock()
+		if before != len(update.Workers) {
+			fmt.Println("[INFO] scheduler: " +
+				strconv.Itoa(len(update.Workers)) + " workers in the cluster")
+		}
+
+		syncPool(update.Workers)
+		runningLock.Lock()
+		idleCond.Broadcast()
+		runningLock.Unlock()
+	}
+}
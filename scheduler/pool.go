@@ -0,0 +1,162 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// connections to the workers are kept open between jobs, dialing
+// for every image was most of the time of small frames. grpc
+// reconnects on its own with backoff, we check every now and then
+// that the worker answers, the ones that dont are skipped until
+// their backoff passes, and after too many failures, or when the
+// controller doesnt have them anymore, they are closed
+type pooledConn struct {
+	conn     *grpc.ClientConn
+	failures int       // in a row
+	retryAt  time.Time // not used until then
+}
+
+var pool = make(map[string]*pooledConn) // by worker url
+var poolLock sync.Mutex
+
+var (
+	healthEvery   = 10 * time.Second
+	healthTimeout = 2 * time.Second
+	retryBase     = time.Second
+	retryMax      = time.Minute
+	maxFailures   = 5
+)
+
+// the same backoff for grpc reconnecting
+var connectParams = grpc.ConnectParams{
+	Backoff: backoff.Config{
+		BaseDelay:  retryBase,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+		MaxDelay:   30 * time.Second,
+	},
+	MinConnectTimeout: 5 * time.Second,
+}
+
+// getConn returns the connection to the worker, it's created the
+// first time. It doesnt wait for it to be ready, the calls do
+func getConn(url string) (*grpc.ClientConn, error) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	if pooled, exists := pool[url]; exists {
+		return pooled.conn, nil
+	}
+	conn, err := grpc.Dial(url, grpc.WithInsecure(),
+		grpc.WithConnectParams(connectParams))
+	if err != nil {
+		return nil, err
+	}
+	pool[url] = &pooledConn{conn: conn}
+	fmt.Println("[INFO] scheduler: connected to worker " + url)
+	return conn, nil
+}
+
+// healthy is false while the worker is in its backoff
+func healthy(url string) bool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	pooled, exists := pool[url]
+	return !exists || pooled.failures == 0 ||
+		time.Now().After(pooled.retryAt)
+}
+
+// reportConn counts the failures of the worker in a row, after
+// maxFailures the connection is closed and dropped
+func reportConn(url string, err error) {
+	poolLock.Lock()
+	pooled, exists := pool[url]
+	if !exists {
+		poolLock.Unlock()
+		return
+	}
+	recovered := false
+	if err == nil {
+		recovered = pooled.failures > 0
+		pooled.failures = 0
+	} else {
+		pooled.failures++
+		wait := retryBase << uint(pooled.failures-1)
+		if wait > retryMax || wait <= 0 {
+			wait = retryMax
+		}
+		pooled.retryAt = time.Now().Add(wait)
+		fmt.Println("[WARN] scheduler: worker " + url + " failed " +
+			"(" + err.Error() + "), skipping it for " + wait.String())
+		if pooled.failures >= maxFailures {
+			pooled.conn.Close()
+			delete(pool, url)
+			fmt.Println("[INFO] scheduler: worker " + url +
+				" failed too many times, connection closed")
+		}
+	}
+	poolLock.Unlock()
+
+	if recovered {
+		// dispatch may be waiting for a worker
+		runningLock.Lock()
+		idleCond.Broadcast()
+		runningLock.Unlock()
+	}
+}
+
+// syncPool closes the connections of the workers that are not in
+// the list of the controller anymore
+func syncPool(workers []Worker) {
+	urls := make(map[string]bool)
+	for _, worker := range workers {
+		urls[worker.Url] = true
+	}
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	for url, pooled := range pool {
+		if !urls[url] {
+			pooled.conn.Close()
+			delete(pool, url)
+			fmt.Println("[INFO] scheduler: worker " + url +
+				" was removed, connection closed")
+		}
+	}
+}
+
+// checkWorkers asks every worker in the pool if it's serving with
+// the grpc health service
+func checkWorkers() {
+	for range time.Tick(healthEvery) {
+		poolLock.Lock()
+		conns := make(map[string]*grpc.ClientConn)
+		for url, pooled := range pool {
+			conns[url] = pooled.conn
+		}
+		poolLock.Unlock()
+
+		for url, conn := range conns {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				healthTimeout)
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+				&healthpb.HealthCheckRequest{})
+			cancel()
+			if status.Code(err) == codes.Unimplemented {
+				// old workers dont have it, answering is enough
+				err = nil
+			} else if err == nil &&
+				resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				err = fmt.Errorf("worker is %s", resp.GetStatus())
+			}
+			reportConn(url, err)
+		}
+	}
+}
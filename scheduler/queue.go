@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+)
+
+// the queue is a weighted fair queue, every user has a flow of jobs
+// for each priority class and the flows take turns. A flow with
+// weight 8 gets 8 jobs scheduled for every job of a flow with
+// weight 1, so interactive workloads jump ahead of batches but the
+// batches still make progress, and a user with a huge workload
+// doesnt starve the rest of the users of the same class
+var weights = map[string]float64{
+	"interactive": 8,
+	"normal":      4,
+	"batch":       1,
+}
+
+// jobs of one user and one priority class, in arrival order.
+// finish is the virtual time at which its next job would be done,
+// the flow with the smallest one goes next
+type flow struct {
+	jobs   []Job
+	weight float64
+	finish float64
+}
+
+// jobs received and not sent to a worker yet, receiving and
+// scheduling are separated so a cancel can drop the jobs that
+// are still waiting
+var flows = make(map[string]*flow)
+var virtualTime float64
+var queueLock sync.Mutex
+var queueCond = sync.NewCond(&queueLock)
+
+// workloads that were cancelled or deleted, their jobs are dropped
+var cancelled = make(map[uint64]bool)
+
+// paused workloads, their jobs stay in the queue until resumed
+var paused = make(map[uint64]bool)
+
+// jobs that left the queue, sent to a worker or dropped. The api
+// uses it to know how many are still ahead of its images
+var dequeued uint64
+
+// enqueue adds the job to the flow of its user and priority, or if
+// it is a cancel, drops the jobs of the workload (a drop, the ones
+// of one image). Pause and resume only mark the workload
+func enqueue(job Job) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	switch job.Action {
+	case "pause":
+		paused[job.WorkloadId] = true
+		return
+	case "resume":
+		delete(paused, job.WorkloadId)
+		queueCond.Broadcast()
+		return
+	case "cancel":
+		delete(paused, job.WorkloadId)
+		cancelled[job.WorkloadId] = true
+		dropped := dropQueued(func(queued Job) bool {
+			return queued.WorkloadId == job.WorkloadId
+		})
+		fmt.Printf("[INFO] scheduler: workload %d cancelled, "+
+			"%d jobs dropped\n", job.WorkloadId, dropped)
+		return
+	case "drop":
+		// the image was deleted
+		dropQueued(func(queued Job) bool {
+			return queued.WorkloadId == job.WorkloadId &&
+				queued.ImageId == job.ImageId
+		})
+		return
+	}
+	if cancelled[job.WorkloadId] {
+		journalAck(job)
+		return
+	}
+
+	weight, exists := weights[job.Priority]
+	if !exists {
+		job.Priority = "normal"
+		weight = weights["normal"]
+	}
+	key := job.Owner + "/" + job.Priority
+	f, exists := flows[key]
+	if !exists {
+		// a new flow starts now, it doesnt get credit for the
+		// time it wasn't there
+		f = &flow{weight: weight, finish: virtualTime + 1/weight}
+		flows[key] = f
+	}
+	f.jobs = append(f.jobs, job)
+	queueCond.Signal()
+}
+
+// dropQueued removes and acks the queued jobs that match, returns
+// how many. Needs queueLock
+func dropQueued(match func(Job) bool) int {
+	dropped := 0
+	for key, f := range flows {
+		var tmp []Job
+		for _, queued := range f.jobs {
+			if !match(queued) {
+				tmp = append(tmp, queued)
+				continue
+			}
+			journalAck(queued)
+		}
+		dropped += len(f.jobs) - len(tmp)
+		dequeued += uint64(len(f.jobs) - len(tmp))
+		f.jobs = tmp
+		if len(f.jobs) == 0 {
+			delete(flows, key)
+		}
+	}
+	return dropped
+}
+
+// dequeue waits until there's a job of a workload that is not
+// paused. The flow with the smallest finish time decides which
+// priority class goes next, inside that class the job with the
+// earliest deadline goes first, from any user. Jobs without a
+// deadline go in the fair order. The jobs of paused workloads keep
+// their place
+func dequeue() Job {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	for {
+		var next *flow
+		var nextKey string
+		index := -1
+		for key, f := range flows {
+			i := firstReady(f)
+			if i < 0 {
+				continue
+			}
+			if next == nil || f.finish < next.finish ||
+				(f.finish == next.finish && key < nextKey) {
+				next, nextKey, index = f, key, i
+			}
+		}
+		if next == nil {
+			queueCond.Wait()
+			continue
+		}
+
+		// earliest deadline of the class
+		for key, f := range flows {
+			if f.jobs[0].Priority != next.jobs[0].Priority {
+				continue
+			}
+			i := earliestDeadline(f)
+			if i < 0 {
+				continue
+			}
+			current := next.jobs[index].Deadline
+			deadline := f.jobs[i].Deadline
+			if current.IsZero() || deadline.Before(current) {
+				next, nextKey, index = f, key, i
+			}
+		}
+
+		job := next.jobs[index]
+		next.jobs = append(next.jobs[:index], next.jobs[index+1:]...)
+		dequeued++
+		if next.finish > virtualTime {
+			virtualTime = next.finish
+		}
+		next.finish += 1 / next.weight
+		if len(next.jobs) == 0 {
+			delete(flows, nextKey)
+		}
+		return job
+	}
+}
+
+// first job of the flow that is not paused
+func firstReady(f *flow) int {
+	for i, job := range f.jobs {
+		if !paused[job.WorkloadId] {
+			return i
+		}
+	}
+	return -1
+}
+
+// job of the flow that is not paused and has the earliest deadline
+func earliestDeadline(f *flow) int {
+	index := -1
+	for i, job := range f.jobs {
+		if paused[job.WorkloadId] || job.Deadline.IsZero() {
+			continue
+		}
+		if index < 0 || job.Deadline.Before(f.jobs[index].Deadline) {
+			index = i
+		}
+	}
+	return index
+}
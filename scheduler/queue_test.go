@@ -0,0 +1,166 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func resetQueue() {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	flows = make(map[string]*flow)
+	virtualTime = 0
+	cancelled = make(map[uint64]bool)
+	paused = make(map[uint64]bool)
+	dequeued = 0
+}
+
+func testJobs(owner string, priority string, workloadId uint64,
+	ids ...uint64) []Job {
+	var jobs []Job
+	for _, id := range ids {
+		jobs = append(jobs, Job{Id: id, ImageId: id, Filter: "blur",
+			Owner: owner, Priority: priority, WorkloadId: workloadId})
+	}
+	return jobs
+}
+
+// a step enqueues the jobs and then dequeues as many as want has,
+// checking the order
+type queueStep struct {
+	jobs []Job
+	want []uint64
+}
+
+func runSteps(t *testing.T, steps []queueStep) {
+	resetQueue()
+	for i, step := range steps {
+		for _, job := range step.jobs {
+			enqueue(job)
+		}
+		var got []uint64
+		for range step.want {
+			got = append(got, dequeue().Id)
+		}
+		if len(step.want) > 0 && !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("step %d: got %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func join(jobs ...[]Job) []Job {
+	var all []Job
+	for _, tmp := range jobs {
+		all = append(all, tmp...)
+	}
+	return all
+}
+
+func TestQueueFairness(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []queueStep
+	}{
+		{"one flow is in order", []queueStep{
+			{testJobs("ana", "normal", 0, 1, 2, 3), []uint64{1, 2, 3}},
+		}},
+		{"users take turns", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2, 3),
+				testJobs("bob", "normal", 1, 4, 5, 6)),
+				[]uint64{1, 4, 2, 5, 3, 6}},
+		}},
+		{"unknown priority is normal", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2),
+				testJobs("bob", "", 1, 3, 4)),
+				[]uint64{1, 3, 2, 4}},
+		}},
+		{"8 interactive for each batch", []queueStep{
+			{join(testJobs("ana", "interactive", 0,
+				1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+				testJobs("bob", "batch", 1, 11, 12)),
+				[]uint64{1, 2, 3, 4, 5, 6, 7, 8, 11, 9, 10, 12}},
+		}},
+		{"a new flow gets no credit", []queueStep{
+			{testJobs("ana", "normal", 0, 1, 2, 3, 4), []uint64{1, 2}},
+			{testJobs("bob", "normal", 1, 5, 6), []uint64{3, 5, 4, 6}},
+		}},
+		{"paused workloads keep their place", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2),
+				[]Job{{WorkloadId: 0, Action: "pause"}},
+				testJobs("bob", "normal", 1, 3, 4)),
+				[]uint64{3, 4}},
+			{[]Job{{WorkloadId: 0, Action: "resume"}}, []uint64{1, 2}},
+		}},
+		{"cancel drops the jobs", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2),
+				testJobs("bob", "normal", 1, 3),
+				[]Job{{WorkloadId: 0, Action: "cancel"}},
+				testJobs("ana", "normal", 0, 4),
+				testJobs("ana", "normal", 2, 5)),
+				[]uint64{5, 3}},
+		}},
+		{"drop removes one image", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2),
+				[]Job{{WorkloadId: 0, ImageId: 1, Action: "drop"}}),
+				[]uint64{2}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runSteps(t, test.steps)
+			queueLock.Lock()
+			left := len(flows)
+			queueLock.Unlock()
+			if left != 0 {
+				t.Errorf("%d flows left in the queue", left)
+			}
+		})
+	}
+}
+
+func withDeadline(jobs []Job, minutes ...int) []Job {
+	now := time.Now()
+	for i, tmp := range minutes {
+		if tmp > 0 {
+			jobs[i].Deadline = now.Add(time.Duration(tmp) * time.Minute)
+		}
+	}
+	return jobs
+}
+
+func TestQueueDeadlines(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []queueStep
+	}{
+		{"earliest deadline of the class first", []queueStep{
+			{join(withDeadline(testJobs("ana", "normal", 0, 1, 2), 0, 60),
+				withDeadline(testJobs("bob", "normal", 1, 3), 10)),
+				[]uint64{3, 2, 1}},
+		}},
+		{"jobs without deadline keep the fair order", []queueStep{
+			{join(testJobs("ana", "normal", 0, 1, 2),
+				withDeadline(testJobs("bob", "normal", 1, 3), 60),
+				testJobs("carl", "normal", 2, 4)),
+				[]uint64{3, 1, 4, 2}},
+		}},
+		{"deadlines dont jump to other classes", []queueStep{
+			{join(withDeadline(testJobs("ana", "batch", 0, 1), 1),
+				testJobs("bob", "interactive", 1, 2, 3)),
+				[]uint64{2, 3, 1}},
+		}},
+		{"paused deadlines wait", []queueStep{
+			{join(withDeadline(testJobs("ana", "normal", 0, 1), 1),
+				[]Job{{WorkloadId: 0, Action: "pause"}},
+				testJobs("bob", "normal", 1, 2)),
+				[]uint64{2}},
+			{[]Job{{WorkloadId: 0, Action: "resume"}}, []uint64{1}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runSteps(t, test.steps)
+		})
+	}
+}
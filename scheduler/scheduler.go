@@ -3,68 +3,184 @@ package scheduler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"sort"
 	"strconv"
 	"time"
 
 	pb "github.com/bsantanad/dc-final/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"go.nanomsg.org/mangos"
 	"go.nanomsg.org/mangos/protocol/pull"
+	"go.nanomsg.org/mangos/protocol/push"
 	_ "go.nanomsg.org/mangos/transport/all"
 )
 
 var schedulerUrl = "tcp://localhost:40902"
+var eventsUrl = "tcp://localhost:40903" // job events to the controller
 
+// Worker is a member of the cluster, see membership.go
 type Worker struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
-	Cpu   uint64 `json:"cpu"`
-	Id    uint64 `json:"id"`
-	Url   string `json:"url"`
-	Api   string `json:"api"`
+	Id   uint64 `json:"id"`
+	Name string `json:"name"` // can be repeated, the url can't
+	Url  string `json:"url"`
+	Cpu  uint64 `json:"cpu"`
 }
 
 type Job struct {
-	Filter  string   `json:"filter"`
-	ImageId uint64   `json:"image_id"`
-	Workers []Worker `json:"workers"`
+	Id         uint64    `json:"job_id"`
+	Filter     string    `json:"filter"`
+	ImageId    uint64    `json:"image_id"`
+	Pixels     uint64    `json:"pixels"`
+	WorkloadId uint64    `json:"workload_id"`
+	Owner      string    `json:"owner"`
+	Priority   string    `json:"priority"`         // interactive, normal or batch
+	Deadline   time.Time `json:"deadline"`         // zero if there's none
+	Action     string    `json:"action,omitempty"` // cancel, drop, pause, resume
+	Epoch      string    `json:"epoch"`            // of the controller, see journal.go
+
+	seq uint64 // position in the queue log, see journal.go
 }
 
-func schedule(job Job) {
+// Event tells the controller that a job started or ended
+type Event struct {
+	// job-started, job-finished, job-failed,
+	// job-timeout, job-duplicated
+	Type       string    `json:"type"`
+	JobId      uint64    `json:"job_id"`
+	WorkloadId uint64    `json:"workload_id"`
+	ImageId    uint64    `json:"image_id"`
+	Filter     string    `json:"filter"`
+	Worker     string    `json:"worker,omitempty"`
+	Time       time.Time `json:"time"`
+	TimeoutMs  int64     `json:"timeout_ms,omitempty"` // what the job was given
+	Error      string    `json:"error,omitempty"`
+	Epoch      string    `json:"epoch"` // the one of the job
+}
 
-	if job.Filter == "" {
-		return
-	}
+// events are sent by their own goroutine on one socket, so the
+// jobs dont wait for the controller
+var events = make(chan Event, 1024)
+
+// dispatch sends each job to an idle worker of the cluster, the
+// jobs run at the
+// same time, one per worker. The controller is told when each of
+// them starts and ends (see finishAttempt). Each job gets a timeout
+// from the size of its image (see timeoutFor), if it runs out the
+// worker stops and the job is a job-timeout instead of a job-failed
+func dispatch() {
+	for {
+		job := dequeue()
+		if job.Filter == "" {
+			journalAck(job)
+			continue
+		}
 
-	// sort array of workers by cpu usage
-	sort.Slice(job.Workers[:], func(i, j int) bool {
-		return job.Workers[i].Cpu < job.Workers[j].Cpu
-	})
+		// without workers the job waits in the queue log until one
+		// joins (see membership.go)
+		runningLock.Lock()
+		worker, ok := idleWorker(nil)
+		for !ok {
+			idleCond.Wait()
+			worker, ok = idleWorker(nil)
+		}
+		run := &runningJob{
+			job:      job,
+			started:  time.Now(),
+			attempts: make(map[string]context.CancelFunc),
+		}
+		running[job.Id] = run
+		timeout := timeoutFor(job)
+		startAttempt(run, worker, timeout)
+		runningLock.Unlock()
+		emit("job-started", job, worker.Name, timeout, nil)
+	}
+}
 
-	url := job.Workers[0].Url
+// schedule sends the job to the worker, it has until the deadline
+// of the context to filter it. The connection comes from the pool
+// (see pool.go). The job id goes in the metadata so the worker can
+// tell the api, only the first image of each job is kept (see
+// postImages)
+func schedule(ctx context.Context, job Job, worker Worker) error {
 	filter := job.Filter
 	imageId := strconv.FormatUint(job.ImageId, 10)
 
-	// Set up a connection to the server.
-	conn, err := grpc.Dial(url, grpc.WithInsecure(), grpc.WithBlock())
+	conn, err := getConn(worker.Url)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		return fmt.Errorf("did not connect: %w", err)
 	}
-	defer conn.Close()
 	c := pb.NewFiltersClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	r, err := c.GrayScale(ctx, &pb.FilterRequest{Filter: filter, Id: imageId})
+	// the connection can still be coming up, the call waits for
+	// it, the time counts for the timeout
+	ctx = metadata.AppendToOutgoingContext(ctx, "job-id",
+		strconv.FormatUint(job.Id, 10))
+	r, err := c.GrayScale(ctx, &pb.FilterRequest{Filter: filter, Id: imageId},
+		grpc.WaitForReady(true))
+	if status.Code(err) == codes.Unavailable {
+		reportConn(worker.Url, err)
+	}
 	if err != nil {
-		log.Fatalf("could not greet: %v", err)
+		return fmt.Errorf("could not filter: %w", err)
+	}
+	if r.GetMessage() == "bad image" {
+		return errors.New("the worker couldnt get the image")
 	}
 	fmt.Println(r.GetMessage())
+	return nil
+}
+
+func emit(eventType string, job Job, worker string, timeout time.Duration,
+	err error) {
+	event := Event{
+		Type:       eventType,
+		JobId:      job.Id,
+		WorkloadId: job.WorkloadId,
+		ImageId:    job.ImageId,
+		Filter:     job.Filter,
+		Worker:     worker,
+		Time:       time.Now().UTC(),
+		TimeoutMs:  timeout.Milliseconds(),
+		Epoch:      job.Epoch,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	select {
+	case events <- event:
+	default:
+		fmt.Println("[WARN] scheduler: too many events, dropping one")
+	}
+}
+
+// PIPELINE push the events to the controller
+func pushEvents() {
+	var sock mangos.Socket
+	var err error
+
+	if sock, err = push.NewSocket(); err != nil {
+		die("can't get new push socket: %s", err.Error())
+	}
+	sock.SetOption(mangos.OptionDialAsynch, true)
+	if err = sock.Dial(eventsUrl); err != nil {
+		die("can't dial on push socket: %s", err.Error())
+	}
+	for event := range events {
+		msg, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if err = sock.Send(msg); err != nil {
+			fmt.Println("[ERROR] scheduler couldnt send event: " +
+				err.Error())
+		}
+	}
 }
 
 func die(format string, v ...interface{}) {
@@ -83,6 +199,14 @@ func Start() {
 	if err = sock.Listen(schedulerUrl); err != nil {
 		die("can't listen on pull socket: %s", err.Error())
 	}
+	loadJournal()
+	go pushEvents()
+	go dispatch()
+	go watchStragglers()
+	go watchLeases()
+	go checkWorkers()
+	go subscribeMembership()
+	go publishStats()
 	for {
 		// Could also use sock.RecvMsg to get header
 		msg, err = sock.Recv()
@@ -97,7 +221,12 @@ func Start() {
 		if err != nil {
 			fmt.Println("[ERROR] controller couldnt parse to image\n" +
 				"bad json sent")
+			continue
+		}
+		adoptEpoch(job.Epoch)
+		enqueue(journalJob(job))
+		if job.Action == "cancel" {
+			forgetDurations(job.WorkloadId)
 		}
-		schedule(job)
 	}
 }
@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a job that was sent to at least one worker. A straggler gets a
+// second attempt on other worker, the first one to finish wins and
+// the other one is cancelled
+type runningJob struct {
+	job        Job
+	started    time.Time
+	attempts   map[string]context.CancelFunc // by worker url
+	duplicated bool
+	done       bool
+}
+
+var running = make(map[uint64]*runningJob)
+var busy = make(map[string]bool) // workers filtering something, by url
+var runningLock sync.Mutex
+var idleCond = sync.NewCond(&runningLock)
+
+// how long the last jobs of each workload took, at most maxSamples
+// each, the workload is forgotten when it's cancelled or deleted
+var durations = make(map[uint64][]time.Duration)
+var maxSamples = 50
+
+var (
+	stragglerFactor = 3.0             // times the median of the workload
+	minSamples      = 3               // jobs finished before we compare
+	minStraggler    = 2 * time.Second // quick jobs are never stragglers
+	checkEvery      = time.Second
+)
+
+// idleWorker is the worker with less cpu usage that isn't
+// filtering anything, isnt in skip and isnt failing (see healthy).
+// Needs runningLock
+func idleWorker(skip map[string]context.CancelFunc) (Worker, bool) {
+	workers := members()
+	// sort array of workers by cpu usage
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Cpu < workers[j].Cpu
+	})
+	for _, worker := range workers {
+		if _, skipped := skip[worker.Url]; skipped || busy[worker.Url] ||
+			!healthy(worker.Url) {
+			continue
+		}
+		return worker, true
+	}
+	return Worker{}, false
+}
+
+// startAttempt sends the job to the worker on its own goroutine.
+// Needs runningLock
+func startAttempt(run *runningJob, worker Worker, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	run.attempts[worker.Url] = cancel
+	busy[worker.Url] = true
+	journalLease(run.job, timeout)
+	go func() {
+		defer cancel()
+		start := time.Now()
+		err := schedule(ctx, run.job, worker)
+		finishAttempt(run, worker, time.Since(start), timeout, err)
+	}()
+}
+
+// finishAttempt keeps the first attempt of the job that finishes
+// and cancels the rest. If an attempt fails while other is still
+// running we wait for that one
+func finishAttempt(run *runningJob, worker Worker, elapsed time.Duration,
+	timeout time.Duration, err error) {
+	job := run.job
+	id := strconv.FormatUint(job.Id, 10)
+	queueLock.Lock()
+	gone := cancelled[job.WorkloadId]
+	queueLock.Unlock()
+
+	runningLock.Lock()
+	delete(run.attempts, worker.Url)
+	delete(busy, worker.Url)
+	idleCond.Broadcast()
+	if run.done {
+		// the other attempt won
+		runningLock.Unlock()
+		return
+	}
+	if err != nil && len(run.attempts) > 0 {
+		fmt.Println("[WARN] scheduler: job " + id + " failed on " +
+			worker.Name + ", waiting for the other attempt")
+		runningLock.Unlock()
+		return
+	}
+	run.done = true
+	for other, cancel := range run.attempts {
+		fmt.Println("[INFO] scheduler: job " + id + " finished on " +
+			worker.Name + ", cancelling it on " + other)
+		cancel()
+	}
+	delete(running, job.Id)
+	journalAck(job)
+	if err == nil && !gone {
+		samples := append(durations[job.WorkloadId], elapsed)
+		if len(samples) > maxSamples {
+			samples = samples[1:]
+		}
+		durations[job.WorkloadId] = samples
+		recordJobTime(elapsed)
+	}
+	runningLock.Unlock()
+
+	if isTimeout(err) {
+		fmt.Println("[ERROR] scheduler: job " + id + " timed out after " +
+			timeout.String())
+		learnCost(job, timeout)
+		emit("job-timeout", job, worker.Name, timeout, err)
+		return
+	}
+	if err != nil {
+		fmt.Println("[ERROR] scheduler: job " + id + " failed: " +
+			err.Error())
+		emit("job-failed", job, worker.Name, timeout, err)
+		return
+	}
+	learnCost(job, elapsed)
+	emit("job-finished", job, worker.Name, timeout, nil)
+}
+
+// forgetDurations is called when the workload is cancelled or
+// deleted, it wont have more jobs
+func forgetDurations(workloadId uint64) {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	delete(durations, workloadId)
+}
+
+// watchStragglers looks for jobs running much longer than the rest
+// of their workload and sends them to other idle worker too, with
+// heterogeneous workers a few slow ones keep the workload running
+// long after everything else finished
+func watchStragglers() {
+	for range time.Tick(checkEvery) {
+		runningLock.Lock()
+		for _, run := range running {
+			if run.done || run.duplicated {
+				continue
+			}
+			median, ok := medianDuration(run.job.WorkloadId)
+			if !ok {
+				continue
+			}
+			elapsed := time.Since(run.started)
+			limit := time.Duration(float64(median) * stragglerFactor)
+			if elapsed < minStraggler || elapsed < limit {
+				continue
+			}
+			worker, ok := idleWorker(run.attempts)
+			if !ok {
+				continue
+			}
+			run.duplicated = true
+			timeout := timeoutFor(run.job)
+			fmt.Println("[INFO] scheduler: job " +
+				strconv.FormatUint(run.job.Id, 10) + " is a straggler (" +
+				elapsed.Round(time.Millisecond).String() + ", median " +
+				median.Round(time.Millisecond).String() +
+				"), duplicating it on " + worker.Name)
+			startAttempt(run, worker, timeout)
+			emit("job-duplicated", run.job, worker.Name, timeout, nil)
+		}
+		runningLock.Unlock()
+	}
+}
+
+// median of the last jobs of the workload. Needs runningLock
+func medianDuration(workloadId uint64) (time.Duration, bool) {
+	samples := durations[workloadId]
+	if len(samples) < minSamples {
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[len(sorted)/2], true
+}
@@ -0,0 +1,171 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func resetRunning(t *testing.T) {
+	reset := func() {
+		runningLock.Lock()
+		running = make(map[uint64]*runningJob)
+		busy = make(map[string]bool)
+		durations = make(map[uint64][]time.Duration)
+		runningLock.Unlock()
+		for len(events) > 0 {
+			<-events
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// nextEvent is the type of the event emitted, "" if there's none
+func nextEvent() string {
+	select {
+	case event := <-events:
+		return event.Type
+	default:
+		return ""
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	resetRunning(t)
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		median  time.Duration
+		ok      bool
+	}{
+		{"no jobs", nil, 0, false},
+		{"too few", []time.Duration{time.Second, time.Second}, 0, false},
+		{"odd", []time.Duration{5 * time.Second, time.Second,
+			3 * time.Second}, 3 * time.Second, true},
+		{"even takes the upper", []time.Duration{4 * time.Second,
+			time.Second, 2 * time.Second, 3 * time.Second}, 3 * time.Second,
+			true},
+		{"one slow job doesnt move it", []time.Duration{time.Second,
+			time.Second, time.Hour}, time.Second, true},
+	}
+	for _, test := range tests {
+		runningLock.Lock()
+		durations[7] = test.samples
+		median, ok := medianDuration(7)
+		runningLock.Unlock()
+		if median != test.median || ok != test.ok {
+			t.Errorf("%s: got %v %v, want %v %v", test.name, median, ok,
+				test.median, test.ok)
+		}
+	}
+
+	forgetDurations(7)
+	runningLock.Lock()
+	_, ok := medianDuration(7)
+	runningLock.Unlock()
+	if ok {
+		t.Error("the workload wasnt forgotten")
+	}
+}
+
+func TestFinishAttempt(t *testing.T) {
+	resetRunning(t)
+	resetQueue()
+	t.Cleanup(resetQueue)
+	slow := Worker{Name: "slow", Url: "slow:50051"}
+	fast := Worker{Name: "fast", Url: "fast:50051"}
+	failed := errors.New("worker crashed")
+	timedOut := context.DeadlineExceeded
+
+	// both attempts are running, they end in order
+	type end struct {
+		worker Worker
+		err    error
+		event  string // emitted, "" if none
+	}
+	tests := []struct {
+		name    string
+		gone    bool // the workload was cancelled
+		ends    []end
+		samples int
+	}{
+		{"first one wins", false, []end{
+			{fast, nil, "job-finished"},
+			{slow, nil, ""},
+		}, 1},
+		{"the other one is waited", false, []end{
+			{fast, failed, ""},
+			{slow, nil, "job-finished"},
+		}, 1},
+		{"both fail", false, []end{
+			{fast, failed, ""},
+			{slow, failed, "job-failed"},
+		}, 0},
+		{"timeouts arent samples", false, []end{
+			{slow, timedOut, ""},
+			{fast, timedOut, "job-timeout"},
+		}, 0},
+		{"cancelled workload", true, []end{
+			{fast, nil, "job-finished"},
+			{slow, nil, ""},
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRunning(t)
+			queueLock.Lock()
+			cancelled[1] = test.gone
+			queueLock.Unlock()
+
+			job := Job{Id: 3, WorkloadId: 1, Filter: "blur"}
+			cancels := make(map[string]bool)
+			run := &runningJob{job: job, started: time.Now(),
+				attempts:   make(map[string]context.CancelFunc),
+				duplicated: true}
+			runningLock.Lock()
+			for _, worker := range []Worker{slow, fast} {
+				url := worker.Url
+				run.attempts[url] = func() { cancels[url] = true }
+				busy[url] = true
+			}
+			running[job.Id] = run
+			runningLock.Unlock()
+
+			for i, end := range test.ends {
+				finishAttempt(run, end.worker, time.Second, time.Minute,
+					end.err)
+				if got := nextEvent(); got != end.event {
+					t.Errorf("end %d: emitted %q, want %q", i, got,
+						end.event)
+				}
+			}
+
+			runningLock.Lock()
+			defer runningLock.Unlock()
+			if !run.done {
+				t.Error("the job isnt done")
+			}
+			if _, exists := running[job.Id]; exists {
+				t.Error("the job is still running")
+			}
+			if len(busy) > 0 {
+				t.Errorf("workers still busy: %v", busy)
+			}
+			if len(durations[1]) != test.samples {
+				t.Errorf("%d samples, want %d", len(durations[1]),
+					test.samples)
+			}
+			// the loser is cancelled only if the winner finished
+			// while it was still running
+			first := test.ends[0]
+			if first.err == nil && !cancels[test.ends[1].worker.Url] {
+				t.Error("the other attempt wasnt cancelled")
+			}
+			if first.err != nil && len(cancels) > 0 {
+				t.Errorf("cancelled %v, it was the last attempt", cancels)
+			}
+		})
+	}
+}
@@ -8,6 +8,9 @@
 # How to pull result images from API
 # python3 stress_test.py -action pull -workload-id test -image-type original -token token -frames-path frames
 #
+# In CI use an api key (POST /keys) instead of the token
+# python3 stress_test.py -action push -workload-id test -api-key dpip_... -frames-path frames
+#
 # TODO
 #
 # - Add timing metrics
@@ -19,14 +22,22 @@ import glob
 import os
 import requests
 import json
+import time
 
 WORKLOADS_API_ENDPOINT='http://localhost:8080/workloads'
 IMAGES_API_ENDPOINT='http://localhost:8080/images'
 
 
+# api keys go in their own header, tokens in Authorization
+def auth_headers(token, api_key):
+    if api_key:
+        return {'X-API-Key': api_key}
+    return {'Authorization': 'Bearer {}'.format(token)}
+
+
 # push_images sends images to the API to be filtered.
 # images (frames) are taken from an specified directory
-def push_images(frames_path, workload_id, token):
+def push_images(frames_path, workload_id, token, api_key=None):
 
     if not os.path.isdir(frames_path):
         print('[{}] frames path doesn\'t exist'.format(frames_path))
@@ -34,16 +45,24 @@ def push_images(frames_path, workload_id, token):
 
     frames = glob.glob('{}/*.png'.format(frames_path))
 
-    data = {'workload_id':workload_id, 'type': 'original'}
-    headers= {'Authorization': 'Bearer {}'.format(token)}
+    headers = auth_headers(token, api_key)
 
     for count in range(0,len(frames)):
         image_path = '{}/{}.png'.format(frames_path,count)
+        # frame is only used by sequence workloads
+        data = {'workload_id':workload_id, 'type': 'original', 'frame': count}
 
         files = {'data': open(image_path,'rb')}
 
         print('Sending {} frame'.format(image_path))
         r = requests.post(IMAGES_API_ENDPOINT, files=files, headers=headers, data=data)
+        # the workers are busy, wait what the api says and try again
+        while r.status_code == 503:
+            wait = int(r.headers.get('Retry-After', 1))
+            print('cluster busy, retrying in {}s'.format(wait))
+            time.sleep(wait)
+            files = {'data': open(image_path,'rb')}
+            r = requests.post(IMAGES_API_ENDPOINT, files=files, headers=headers, data=data)
         print(IMAGES_API_ENDPOINT, data)
         print(r.status_code)
         print(r.text)
@@ -72,14 +91,22 @@ def pull_images(frames_path, workload_id, image_type, token):
         if r.status_code == 200:
             open(image_path, 'wb').write(r.content)
 
-def pull_filtered(frames_path, workload_id, image_type, token):
+def pull_filtered(frames_path, workload_id, image_type, token, api_key=None):
     if not os.path.isdir(frames_path):
         os.mkdir(frames_path)
 
-    headers= {'Authorization': 'Bearer {}'.format(token)}
-    images_url = '{}'.format(IMAGES_API_ENDPOINT)
-    r = requests.get(images_url, headers=headers)
-    images_info = json.loads(r.text)
+    headers = auth_headers(token, api_key)
+    images_url = '{}?workload_id={}&type=filtered'.format(IMAGES_API_ENDPOINT,
+                                                          workload_id)
+    images_info = []
+    # follow the next links until the last page
+    while images_url:
+        r = requests.get(images_url, headers=headers)
+        page = json.loads(r.text)
+        images_info += page['images']
+        images_url = ''
+        if page.get('next'):
+            images_url = 'http://localhost:8080{}'.format(page['next'])
 
     for images in images_info:
         if images['type'] == 'filtered':
@@ -100,11 +127,13 @@ if __name__ == '__main__':
     parser.add_argument('-workload-id', default='test', help='Workload identifier')
     parser.add_argument('-image-type', default='filtered', help='filtered or original')
     parser.add_argument('-token', default='token', help='API Token')
+    parser.add_argument('-api-key', default=os.environ.get('DPIP_API_KEY'),
+                        help='API key, used instead of the token (or set DPIP_API_KEY)')
     parser.add_argument('-frames-path', default='frames', help='frames path')
 
     args = parser.parse_args()
     if args.action == 'push':
-        push_images(args.frames_path, args.workload_id, args.token)
+        push_images(args.frames_path, args.workload_id, args.token, args.api_key)
     elif args.action == 'pull':
         #pull_images(args.frames_path, args.workload_id, args.image_type, args.token)
-        pull_filtered(args.frames_path, args.workload_id, args.image_type, args.token)
+        pull_filtered(args.frames_path, args.workload_id, args.image_type, args.token, args.api_key)
@@ -0,0 +1,65 @@
+#!/bin/env python3
+
+# local receiver to test webhooks, it checks the signature and prints
+# the events it gets
+#
+# python3 webhook_receiver.py -port 9000 -secret <secret from POST /webhooks>
+#
+# then register it with
+# curl -H "Authorization: Bearer <token>" -X POST \
+#      -d '{"url": "http://localhost:9000/hook"}' localhost:8080/webhooks
+#
+# -fail N answers 500 to the first N requests, to see the retries
+
+
+import argparse
+import hashlib
+import hmac
+import json
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+SECRET = b''
+FAILURES = 0
+
+
+class Receiver(BaseHTTPRequestHandler):
+
+    def do_POST(self):
+        global FAILURES
+        body = self.rfile.read(int(self.headers.get('Content-Length', 0)))
+
+        expected = 'sha256=' + hmac.new(SECRET, body, hashlib.sha256).hexdigest()
+        signature = self.headers.get('X-DPIP-Signature', '')
+        if not hmac.compare_digest(expected, signature):
+            print('[{}] bad signature'.format(self.headers.get('X-DPIP-Delivery')))
+            self.send_response(401)
+            self.end_headers()
+            return
+
+        if FAILURES > 0:
+            FAILURES -= 1
+            print('[{}] failing on purpose'.format(self.headers.get('X-DPIP-Delivery')))
+            self.send_response(500)
+            self.end_headers()
+            return
+
+        print(self.headers.get('X-DPIP-Event'), json.dumps(json.loads(body), indent=4))
+        self.send_response(204)
+        self.end_headers()
+
+    def log_message(self, format, *args):
+        pass
+
+
+if __name__ == '__main__':
+
+    parser = argparse.ArgumentParser()
+    parser.add_argument('-port', default=9000, type=int, help='port to listen on')
+    parser.add_argument('-secret', required=True, help='secret of the webhook')
+    parser.add_argument('-fail', default=0, type=int, help='requests to answer with 500')
+
+    args = parser.parse_args()
+    SECRET = args.secret.encode()
+    FAILURES = args.fail
+    print('listening on port {}'.format(args.port))
+    HTTPServer(('', args.port), Receiver).serve_forever()
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	_ "image/gif" // single frame gifs are filtered as any image
 	"io"
 	"io/ioutil"
 	"log"
@@ -15,9 +17,15 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	pb "github.com/bsantanad/dc-final/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/anthonynsimon/bild/blur"
 	"github.com/anthonynsimon/bild/effect"
@@ -48,15 +56,23 @@ var (
 
 // shared structs
 type Worker struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
-	Cpu   uint64 `json:"cpu"`
-	Id    uint64 `json:"id"`
-	Url   string `json:"url"`
-	Api   string `json:"api"`
+	Name    string `json:"name"`
+	Token   string `json:"token"`
+	Refresh string `json:"refresh_token"`
+	Cpu     uint64 `json:"cpu"`
+	Id      uint64 `json:"id"`
+	Url     string `json:"url"`
+	Api     string `json:"api"`
 }
 
-var WorkerInfo Worker // stores worker name, token and cpu
+var WorkerInfo Worker    // stores worker name, token and cpu
+var tokenLock sync.Mutex // jobs run concurrently, tokens are shared
+
+var (
+	heartbeatEvery   = 5 * time.Second
+	heartbeatTimeout = 2 * time.Second
+	errUnknownWorker = errors.New("the controller doesnt know this worker")
+)
 
 func die(format string, v ...interface{}) {
 	fmt.Fprintln(os.Stderr, fmt.Sprintf(format, v...))
@@ -64,34 +80,83 @@ func die(format string, v ...interface{}) {
 }
 
 // GrayScale, get image, check filter, filter image, upload image to api
-// updateCpu usage
+// updateCpu usage. The scheduler gives each job a deadline, when it
+// passes we stop and dont upload anything
 func (s *server) GrayScale(ctx context.Context,
 	in *pb.FilterRequest) (*pb.FilterReply, error) {
 	// get image by id from api
-	imageName := getImage(in.GetId())
+	imageName := getImage(ctx, in.GetId())
 	if len(imageName) == 0 {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
 		return &pb.FilterReply{Message: "bad image"}, nil
 	}
-	// blur it
+
+	// bild can't be stopped halfway, so it runs on its own and we
+	// just dont wait for it when the deadline passes. Every job has
+	// its own file (see getImage) so it doesnt matter if the image
+	// comes again while it's still running
+	done := make(chan string, 1)
+	go func() {
+		done <- filterImage(ctx, imageName, in.GetFilter(), in.GetId())
+	}()
 	var msg string
-	if in.GetFilter() == "blur" {
-		blury(imageName)
-		msg = "[INFO] image " + in.GetId() + " has been blured"
-		fmt.Println("[INFO] I just blured an image")
-	}
-	if in.GetFilter() == "grayscale" {
-		grayscaly(imageName)
-		msg = "[INFO] image " + in.GetId() + " has been grayscaled"
-		fmt.Println("[INFO] I just grayscaled an image")
+	select {
+	case msg = <-done:
+	case <-ctx.Done():
+		fmt.Println("[WARN] image " + in.GetId() + " ran out of time, " +
+			"dropping it")
+		// the file is only this job's, the goroutine removes it
+		// when bild is done (it doesnt save it, see blury)
+		go func() {
+			<-done
+			os.Remove(imageName)
+		}()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	// post image, with the job id the api keeps only the first
+	// image of the job, the scheduler can send it to two workers
+	var jobId string
+	if md, ok := metadata.FromIncomingContext(ctx); ok &&
+		len(md.Get("job-id")) > 0 {
+		jobId = md.Get("job-id")[0]
+	}
+	if err := postImage(ctx, imageName, in.GetId(), jobId); err != nil {
+		fmt.Println("[ERROR] couldnt upload image " + in.GetId() +
+			": " + err.Error())
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, err
 	}
-	// post image
-	postImage(imageName)
 
 	// update cpu usage
-	updateCPU()
+	if err := updateCPU(); err != nil {
+		fmt.Println("[WARN] couldnt update cpu: " + err.Error())
+	}
 
 	return &pb.FilterReply{Message: msg}, nil
 }
+
+// filterImage applies the filter to the image in the file
+func filterImage(ctx context.Context, imageName string, filter string,
+	id string) string {
+	var msg string
+	// blur it
+	if filter == "blur" {
+		blury(ctx, imageName)
+		msg = "[INFO] image " + id + " has been blured"
+		fmt.Println("[INFO] I just blured an image")
+	}
+	if filter == "grayscale" {
+		grayscaly(ctx, imageName)
+		msg = "[INFO] image " + id + " has been grayscaled"
+		fmt.Println("[INFO] I just grayscaled an image")
+	}
+	return msg
+}
 func (s *server) Blur(ctx context.Context,
 	in *pb.FilterRequest) (*pb.FilterReply, error) {
 	return &pb.FilterReply{Message: "Hello "}, nil
@@ -106,8 +171,9 @@ func init() {
 		"Comma-separated worker tags")
 }
 
-// blur image with blid
-func blury(name string) {
+// blur image with blid, if the job ran out of time meanwhile the
+// result is not saved
+func blury(ctx context.Context, name string) {
 	img, err := imgio.Open(name)
 	if err != nil {
 		fmt.Println(err)
@@ -115,6 +181,9 @@ func blury(name string) {
 	}
 
 	result := blur.Gaussian(img, 10.0)
+	if ctx.Err() != nil {
+		return
+	}
 
 	if err := imgio.Save(name,
 		result, imgio.PNGEncoder()); err != nil {
@@ -123,8 +192,8 @@ func blury(name string) {
 	}
 }
 
-// grayscale image with blid
-func grayscaly(name string) {
+// grayscale image with blid, same as blury
+func grayscaly(ctx context.Context, name string) {
 	img, err := imgio.Open(name)
 	if err != nil {
 		fmt.Println(err)
@@ -132,6 +201,9 @@ func grayscaly(name string) {
 	}
 
 	result := effect.Grayscale(img)
+	if ctx.Err() != nil {
+		return
+	}
 
 	if err := imgio.Save(name,
 		result, imgio.PNGEncoder()); err != nil {
@@ -142,13 +214,11 @@ func grayscaly(name string) {
 }
 
 // GET request to api for image
-func getImage(imageId string) string {
+func getImage(ctx context.Context, imageId string) string {
 	url := WorkerInfo.Api + "/images/" + imageId
 	//fmt.Println(url)
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+WorkerInfo.Token)
-	resp, err := client.Do(req)
+	resp, err := apiDo(ctx, client, "GET", url, nil, "")
 	if err != nil {
 		fmt.Println(err)
 		return ""
@@ -163,35 +233,53 @@ func getImage(imageId string) string {
 		return ""
 	}
 
-	// download image
-	permissions := 0775
-	name := "tmp_image" + imageId
-	err = ioutil.WriteFile(name, body, os.FileMode(permissions))
+	// download image, to a new file for every job, a job that ran
+	// out of time can still be using the last one
+	if ctx.Err() != nil {
+		return ""
+	}
+	file, err := os.CreateTemp("", "dpip-image-"+imageId+"-*")
+	if err != nil {
+		fmt.Println(err.Error())
+		return ""
+	}
+	_, err = file.Write(body)
+	if e := file.Close(); err == nil {
+		err = e
+	}
 	if err != nil {
 		fmt.Println(err.Error())
+		os.Remove(file.Name())
 		return ""
 	}
-	return name
+	return file.Name()
 }
 
-// postImage to api
+// postImage to api, sourceId is the id of the original image
 // code from https://stackoverflow.com/a/20397167
-func postImage(name string) {
+func postImage(ctx context.Context, name string, sourceId string,
+	jobId string) error {
+	if err := ctx.Err(); err != nil {
+		os.Remove(name)
+		return err
+	}
 	url := WorkerInfo.Api + "/images"
 	client := &http.Client{}
 	//prepare the reader instances to encode
 	values := map[string]io.Reader{
-		"data": mustOpen(name), // lets assume its this file
-		"type": strings.NewReader("filtered"),
+		"data":      mustOpen(name), // lets assume its this file
+		"type":      strings.NewReader("filtered"),
+		"source_id": strings.NewReader(sourceId),
 	}
-	err := Upload(client, url, values)
-	if err != nil {
-		panic(err)
+	if jobId != "" {
+		values["job_id"] = strings.NewReader(jobId)
 	}
+	err := Upload(ctx, client, url, values)
 	e := os.Remove(name)
 	if e != nil {
 		fmt.Println("[WARN] couldnt delete tmp file")
 	}
+	return err
 }
 
 func mustOpen(f string) *os.File {
@@ -203,7 +291,7 @@ func mustOpen(f string) *os.File {
 }
 
 // code from https://stackoverflow.com/a/20397167
-func Upload(client *http.Client, url string,
+func Upload(ctx context.Context, client *http.Client, url string,
 	values map[string]io.Reader) (err error) {
 
 	// Prepare a form that you will submit to that URL.
@@ -235,16 +323,9 @@ func Upload(client *http.Client, url string,
 	w.Close()
 
 	// Now that you have a form, you can submit it to your handler.
-	req, err := http.NewRequest("POST", url, &b)
-	if err != nil {
-		return
-	}
 	// Don't forget to set the content type, this will contain the boundary.
-	req.Header.Add("Authorization", "Bearer "+WorkerInfo.Token)
-	req.Header.Set("Content-Type", w.FormDataContentType())
-
-	// Submit the request
-	res, err := client.Do(req)
+	res, err := apiDo(ctx, client, "POST", url, b.Bytes(),
+		w.FormDataContentType())
 	if err != nil {
 		return
 	}
@@ -256,6 +337,74 @@ func Upload(client *http.Client, url string,
 	return
 }
 
+// apiDo sends a request to the api with the worker token, if the
+// api answers 401 (the token expired) it gets new tokens with the
+// refresh token and tries once more
+func apiDo(ctx context.Context, client *http.Client, method string,
+	url string, body []byte, contentType string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		tokenLock.Lock()
+		token := WorkerInfo.Token
+		tokenLock.Unlock()
+
+		req, err := http.NewRequestWithContext(ctx, method, url,
+			bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err = refreshToken(token); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// refreshToken uses POST /refresh to replace the expired token,
+// if other job already did it there's nothing to do
+func refreshToken(expired string) error {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	if WorkerInfo.Token != expired {
+		return nil
+	}
+
+	reqStr, err := json.Marshal(map[string]string{
+		"refresh_token": WorkerInfo.Refresh,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(WorkerInfo.Api+"/refresh", "application/json",
+		bytes.NewReader(reqStr))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldnt refresh token: %s", resp.Status)
+	}
+
+	var tokens Worker
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return err
+	}
+	WorkerInfo.Token = tokens.Token
+	WorkerInfo.Refresh = tokens.Refresh
+	fmt.Println("[INFO] worker token has been refreshed")
+	return nil
+}
+
 // joinCluster works with controller in a REQREP way. The worker
 // tells the controller that he is up and running (sends name and cpu).
 // The controller returns a token for him to use the api
@@ -304,7 +453,9 @@ func joinCluster(url string) {
 		return
 	}
 
+	tokenLock.Lock()
 	WorkerInfo = tmp
+	tokenLock.Unlock()
 	fmt.Println("[INFO] worker " + tmp.Name + " has been registered with " +
 		"workers id: " + strconv.FormatUint(tmp.Id, 10))
 	sock.Close()
@@ -314,56 +465,71 @@ func joinCluster(url string) {
 // we can diff this request from the joinCluster one
 // because in one we dont send the name of the worker,
 // just the id, we check this and do the proper
-// thing in the controller
-func updateCPU() {
+// thing in the controller. It's also the heartbeat, the
+// controller removes the workers it doesnt hear from
+func updateCPU() error {
 	var sock mangos.Socket
 	var err error
 	var msg []byte
 
 	if sock, err = req.NewSocket(); err != nil {
-		die("can't get new req socket: %s", err.Error())
+		return fmt.Errorf("can't get new req socket: %s", err.Error())
 	}
+	defer sock.Close()
+	sock.SetOption(mangos.OptionRecvDeadline, heartbeatTimeout)
+	sock.SetOption(mangos.OptionSendDeadline, heartbeatTimeout)
 	//fmt.Println(controllerAddress)
 	if err = sock.Dial(controllerAddress); err != nil {
-		die("can't dial on req socket: %s\n%s", err.Error(), controllerAddress)
+		return fmt.Errorf("can't dial on req socket: %s", err.Error())
 	}
 
 	stat, err := linuxproc.ReadStat("/proc/stat")
 	if err != nil {
 		fmt.Println("stat read fail")
+		return err
 	}
 
 	var tmp Worker
 	tmp.Cpu = stat.CPUStatAll.User
+	tokenLock.Lock()
 	tmp.Id = WorkerInfo.Id
+	tokenLock.Unlock()
 
 	tmpStr, err := json.Marshal(tmp)
 	if err != nil {
-		fmt.Println("worker coudn't get his info")
-		return
+		return errors.New("worker coudn't get his info")
 	}
 
 	// send worker info to controller
 	if err = sock.Send([]byte(tmpStr)); err != nil {
-		die("can't send message on push socket: %s", err.Error())
+		return fmt.Errorf("can't send message on req socket: %s",
+			err.Error())
 	}
 
-	// receive controller response (worker struct with token)
+	// receive controller response
 	if msg, err = sock.Recv(); err != nil {
-		die("can't receive date: %s", err.Error())
+		return fmt.Errorf("can't receive date: %s", err.Error())
 	}
-	if string(msg) == "cpu_cool" {
-		fmt.Println("[INFO] cpu has been updated " +
-			"workers cpu: " + strconv.FormatUint(tmp.Cpu, 10))
+	if string(msg) == "unknown_worker" {
+		return errUnknownWorker
 	}
-	if err != nil {
-		fmt.Println("[ERROR] worker couldnt update cpu\n" +
-			"bad json sent")
-		return
-	}
-
-	sock.Close()
+	return nil
+}
 
+// heartbeat tells the controller we're alive every few seconds, if
+// the controller restarted and doesnt know us we join again
+func heartbeat(url string) {
+	for range time.Tick(heartbeatEvery) {
+		err := updateCPU()
+		if err == errUnknownWorker {
+			fmt.Println("[INFO] the controller forgot us, joining again")
+			joinCluster(url)
+			continue
+		}
+		if err != nil {
+			fmt.Println("[WARN] heartbeat failed: " + err.Error())
+		}
+	}
 }
 
 func getAvailablePort() int {
@@ -389,7 +555,10 @@ func main() {
 
 	// Subscribe to Controller
 	hostname := "localhost:" + strconv.Itoa(rpcPort)
-	go joinCluster(hostname)
+	go func() {
+		joinCluster(hostname)
+		heartbeat(hostname)
+	}()
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%v", rpcPort))
 	if err != nil {
@@ -397,6 +566,8 @@ func main() {
 	}
 	s := grpc.NewServer()
 	pb.RegisterFiltersServer(s, &server{})
+	// the scheduler checks we're alive with this
+	healthpb.RegisterHealthServer(s, health.NewServer())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}